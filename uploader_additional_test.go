@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,7 +23,7 @@ func TestHandleJobUnknownAction(t *testing.T) {
 	}
 
 	// Should not panic
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 func TestHandleJobGenerateThumb(t *testing.T) {
@@ -31,7 +35,7 @@ func TestHandleJobGenerateThumb(t *testing.T) {
 	}
 
 	// Should not panic
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 func TestHandleJobViperLogin(t *testing.T) {
@@ -47,7 +51,7 @@ func TestHandleJobViperLogin(t *testing.T) {
 	}
 
 	// Should not panic
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 func TestHandleJobViperPost(t *testing.T) {
@@ -60,7 +64,7 @@ func TestHandleJobViperPost(t *testing.T) {
 	}
 
 	// Should not panic
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 // --- waitForRateLimit Tests ---
@@ -179,6 +183,84 @@ func TestSendJSONConcurrent(t *testing.T) {
 	}
 }
 
+func TestEventOutputWritesWholeLinesAndDetectsClosedPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newEventOutput(w)
+	// Larger than the pipe buffer's atomic write size
+	long := []byte(`{"type":"log","msg":"` + strings.Repeat("x", 100*1024) + `"}` + "\n")
+	got := make(chan []byte)
+	go func() {
+		line, _ := bufio.NewReaderSize(r, 256*1024).ReadBytes('\n')
+		got <- line
+	}()
+	o.writeLine(long)
+	if line := <-got; !bytes.Equal(line, long) {
+		t.Errorf("read %d bytes, want the whole %d-byte line", len(line), len(long))
+	}
+	select {
+	case <-o.closed:
+		t.Fatal("closed after a successful write")
+	default:
+	}
+
+	_ = r.Close()
+	o.writeLine([]byte("{}\n"))
+	select {
+	case <-o.closed:
+	default:
+		t.Fatal("a write to a closed pipe was not detected")
+	}
+	if o.err == nil {
+		t.Error("write error not kept")
+	}
+	o.writeLine([]byte("{}\n")) // dropped, and must not close closed twice
+}
+
+func TestReadRequestsClosesOnEOF(t *testing.T) {
+	out := make(chan JobRequest)
+	input := `{"action":"job_status"}` + "\n" + `{"action": 5}` + "\n" + `{"action":"usage_report"}`
+	var got []string
+	captureEvents(t, func() {
+		go readRequests(strings.NewReader(input), DefaultMaxRequestBytes, out)
+		for job := range out {
+			got = append(got, job.Action)
+		}
+	})
+	if strings.Join(got, ",") != "job_status,usage_report" {
+		t.Errorf("decoded %v", got)
+	}
+}
+
+func TestReadRequestsSkipsBadLines(t *testing.T) {
+	out := make(chan JobRequest)
+	input := `{"action":"job_status"}` + "\n" +
+		`{"action": "upload", "files": [` + "\n" + // broken JSON must not stop the lines after it
+		`{"action":"ping","id":"p1"}` + "\r\n\n" +
+		`{"action":"upload","files":["` + strings.Repeat("a", 300) + `"]}` + "\n" +
+		`{"action":"usage_report"}` + "\n"
+	var got []string
+	events := captureEvents(t, func() {
+		go readRequests(strings.NewReader(input), 200, out)
+		for job := range out {
+			got = append(got, job.Action)
+		}
+	})
+	if strings.Join(got, ",") != "job_status,ping,usage_report" {
+		t.Errorf("decoded %v", got)
+	}
+	if len(events) != 2 || !strings.Contains(events[0].Msg, "line 2") || !strings.Contains(events[1].Msg, "line 5 is over 200 bytes") {
+		t.Errorf("events %+v", events)
+	}
+
+	events = captureEvents(t, func() { handleJob(context.Background(), JobRequest{Action: "ping", ID: "p1"}) })
+	if len(events) != 1 || events[0].Type != "pong" || events[0].JobID != "p1" {
+		t.Errorf("ping answered with %+v", events)
+	}
+}
+
 // --- JobRequest Structure Tests ---
 
 func TestJobRequestAllFields(t *testing.T) {
@@ -324,6 +406,53 @@ func BenchmarkHandleJob(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		handleJob(job)
+		handleJob(context.Background(), job)
+	}
+}
+
+func TestJobQueueRunsInteractiveJobsFirst(t *testing.T) {
+	q := newJobQueue()
+	stop := make(chan struct{})
+	for _, job := range []JobRequest{
+		{ID: "upload-1", Action: "upload"},
+		{ID: "upload-2", Action: "upload"},
+		{ID: "thumb", Action: "generate_thumb"},
+		{ID: "urgent", Action: "upload", Priority: 20},
+		{ID: "login", Action: "login"},
+		{ID: "later", Action: "upload", Priority: -1},
+	} {
+		if !q.push(job, stop) {
+			t.Fatal("push failed")
+		}
+	}
+	if d := q.depth(); d != 6 {
+		t.Errorf("depth = %d, want 6", d)
+	}
+	q.close()
+
+	var order []string
+	for job := range q.ready {
+		order = append(order, job.ID)
+	}
+	if got := strings.Join(order, ","); got != "urgent,thumb,login,upload-1,upload-2,later" {
+		t.Errorf("jobs ran in order %s", got)
+	}
+	if d := q.depth(); d != 0 {
+		t.Errorf("depth = %d after draining", d)
+	}
+}
+
+func TestJobQueuePushStopsWhenFull(t *testing.T) {
+	q := newJobQueue()
+	defer q.close()
+	stop := make(chan struct{})
+	for i := 0; i < MaxQueuedJobs; i++ {
+		if !q.push(JobRequest{Action: "upload"}, stop) {
+			t.Fatal("push failed")
+		}
+	}
+	close(stop)
+	if q.push(JobRequest{Action: "generate_thumb"}, stop) {
+		t.Error("push into a full queue returned before stop")
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -106,20 +107,19 @@ func TestCreatePixhostGallery(t *testing.T) {
 	}))
 	defer server.Close()
 
-	// Temporarily replace API URL for testing
+	// Send api.pixhost.to to the mock server
+	target, _ := url.Parse(server.URL)
 	oldClient := client
-	client = &http.Client{Timeout: 5 * time.Second}
+	client = newHTTPClient(hostOverrides{"api.pixhost.to": target})
 	defer func() { client = oldClient }()
 
-	// Note: This would require modifying the function to accept a custom URL
-	// For now, we test that the function exists and has proper signature
-	result, err := createPixhostGallery("Test Gallery")
+	result, err := createPixhostGallery(context.Background(), "Test Gallery")
 	if err != nil {
-		// Expected to fail since we're not using the mock server
-		// This tests error handling
-		t.Logf("createPixhostGallery error (expected): %v", err)
+		t.Fatalf("createPixhostGallery failed: %v", err)
+	}
+	if result["gallery_hash"] != "abc123" || result["gallery_upload_hash"] != "upload456" {
+		t.Errorf("unexpected result: %v", result)
 	}
-	_ = result
 }
 
 func TestCreatePixhostGalleryEmptyTitle(t *testing.T) {
@@ -127,7 +127,7 @@ func TestCreatePixhostGalleryEmptyTitle(t *testing.T) {
 	initHTTPClient()
 
 	// Test with empty title
-	_, err := createPixhostGallery("")
+	_, err := createPixhostGallery(context.Background(), "")
 	if err != nil {
 		t.Logf("createPixhostGallery with empty title error: %v", err)
 	}
@@ -142,7 +142,7 @@ func TestCreateImxGallery(t *testing.T) {
 	}
 
 	// This will fail in real execution but tests error handling
-	_, err := createImxGallery(creds, "Test Gallery")
+	_, err := createImxGallery(context.Background(), creds, "Test Gallery", false)
 	if err != nil {
 		t.Logf("createImxGallery error (expected without server): %v", err)
 	}
@@ -152,7 +152,7 @@ func TestCreateViprGallery(t *testing.T) {
 	initHTTPClient()
 
 	// This will fail in real execution but tests error handling
-	_, err := createViprGallery("Test Gallery")
+	_, err := createViprGallery(context.Background(), "Test Gallery")
 	if err != nil {
 		t.Logf("createViprGallery error (expected): %v", err)
 	}
@@ -177,7 +177,7 @@ func TestHandleFinalizeGalleryPixhost(t *testing.T) {
 		}
 	}()
 
-	handleFinalizeGallery(job)
+	handleFinalizeGallery(context.Background(), job)
 }
 
 func TestHandleFinalizeGalleryMissingHashes(t *testing.T) {
@@ -193,7 +193,7 @@ func TestHandleFinalizeGalleryMissingHashes(t *testing.T) {
 		}
 	}()
 
-	handleFinalizeGallery(job)
+	handleFinalizeGallery(context.Background(), job)
 }
 
 func TestHandleFinalizeGalleryOtherService(t *testing.T) {
@@ -211,7 +211,7 @@ func TestHandleFinalizeGalleryOtherService(t *testing.T) {
 		}
 	}()
 
-	handleFinalizeGallery(job)
+	handleFinalizeGallery(context.Background(), job)
 }
 
 // --- Gallery Handling Tests ---
@@ -231,7 +231,7 @@ func TestHandleCreateGalleryPixhost(t *testing.T) {
 		}
 	}()
 
-	handleCreateGallery(job)
+	handleCreateGallery(context.Background(), job)
 }
 
 func TestHandleCreateGalleryImx(t *testing.T) {
@@ -253,7 +253,7 @@ func TestHandleCreateGalleryImx(t *testing.T) {
 		}
 	}()
 
-	handleCreateGallery(job)
+	handleCreateGallery(context.Background(), job)
 }
 
 func TestHandleCreateGalleryVipr(t *testing.T) {
@@ -271,7 +271,7 @@ func TestHandleCreateGalleryVipr(t *testing.T) {
 		}
 	}()
 
-	handleCreateGallery(job)
+	handleCreateGallery(context.Background(), job)
 }
 
 func TestHandleCreateGalleryImageBam(t *testing.T) {
@@ -289,7 +289,7 @@ func TestHandleCreateGalleryImageBam(t *testing.T) {
 		}
 	}()
 
-	handleCreateGallery(job)
+	handleCreateGallery(context.Background(), job)
 }
 
 func TestHandleCreateGalleryUnsupported(t *testing.T) {
@@ -307,7 +307,7 @@ func TestHandleCreateGalleryUnsupported(t *testing.T) {
 		}
 	}()
 
-	handleCreateGallery(job)
+	handleCreateGallery(context.Background(), job)
 }
 
 // --- Login/Verify Tests ---
@@ -327,7 +327,7 @@ func TestHandleLoginVerifyImxWithApiKey(t *testing.T) {
 		}
 	}()
 
-	handleLoginVerify(job)
+	handleLoginVerify(context.Background(), job)
 }
 
 func TestHandleLoginVerifyDefault(t *testing.T) {
@@ -343,7 +343,7 @@ func TestHandleLoginVerifyDefault(t *testing.T) {
 		}
 	}()
 
-	handleLoginVerify(job)
+	handleLoginVerify(context.Background(), job)
 }
 
 // --- List Galleries Tests ---
@@ -364,7 +364,7 @@ func TestHandleListGalleriesImx(t *testing.T) {
 		}
 	}()
 
-	handleListGalleries(job)
+	handleListGalleries(context.Background(), job)
 }
 
 func TestHandleListGalleriesVipr(t *testing.T) {
@@ -383,7 +383,7 @@ func TestHandleListGalleriesVipr(t *testing.T) {
 		}
 	}()
 
-	handleListGalleries(job)
+	handleListGalleries(context.Background(), job)
 }
 
 func TestHandleListGalleriesImageBam(t *testing.T) {
@@ -402,7 +402,7 @@ func TestHandleListGalleriesImageBam(t *testing.T) {
 		}
 	}()
 
-	handleListGalleries(job)
+	handleListGalleries(context.Background(), job)
 }
 
 // --- HTTP Spec Tests ---
@@ -421,7 +421,7 @@ func TestHandleHttpUploadMissingSpec(t *testing.T) {
 		}
 	}()
 
-	handleHttpUpload(job)
+	handleHttpUpload(context.Background(), job)
 }
 
 func TestHandleHttpUploadEmptyFiles(t *testing.T) {
@@ -441,7 +441,7 @@ func TestHandleHttpUploadEmptyFiles(t *testing.T) {
 		}
 	}()
 
-	handleHttpUpload(job)
+	handleHttpUpload(context.Background(), job)
 }
 
 // --- SendJSON Tests ---
@@ -566,7 +566,7 @@ func TestProcessFileGenericWithSpec(t *testing.T) {
 		}
 	}()
 
-	processFileGeneric("nonexistent.jpg", &job)
+	processFileGeneric(context.Background(), "nonexistent.jpg", &job)
 }
 
 // --- Benchmark Tests ---
@@ -607,7 +607,7 @@ func BenchmarkCreatePixhostGallery(b *testing.B) {
 	// Note: This will fail due to network, but benchmarks the call overhead
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = createPixhostGallery("Benchmark Gallery")
+		_, _ = createPixhostGallery(context.Background(), "Benchmark Gallery")
 	}
 }
 
@@ -762,5 +762,5 @@ func TestHandleJobPanic(t *testing.T) {
 		}
 	}()
 
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
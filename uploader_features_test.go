@@ -0,0 +1,2977 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// --- Anonymous Mode Tests ---
+
+func TestIsAnonymous(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		want   bool
+	}{
+		{"nil config", nil, false},
+		{"missing key", map[string]string{}, false},
+		{"true", map[string]string{"anonymous": "true"}, true},
+		{"one", map[string]string{"anonymous": "1"}, true},
+		{"false", map[string]string{"anonymous": "false"}, false},
+		{"garbage", map[string]string{"anonymous": "yes please"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAnonymous(tt.config); got != tt.want {
+				t.Errorf("isAnonymous(%v) = %v, want %v", tt.config, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHttpClientForAnonymousHasNoJar(t *testing.T) {
+	initHTTPClient()
+
+	if c := httpClientFor(context.Background()); c != client {
+		t.Error("httpClientFor should return the shared client for normal contexts")
+	}
+
+	anon := httpClientFor(withAnonymous(context.Background()))
+	if anon == client {
+		t.Fatal("httpClientFor should not return the shared client in anonymous mode")
+	}
+	if anon.Jar != nil {
+		t.Error("anonymous client must not carry a cookie jar")
+	}
+	if anon.Transport != client.Transport {
+		t.Error("anonymous client should reuse the shared transport")
+	}
+}
+
+func TestHandleJobAnonymousUnsupportedService(t *testing.T) {
+	initHTTPClient()
+
+	tmpFile := t.TempDir() + "/test.jpg"
+	if err := createTestImage(tmpFile); err != nil {
+		t.Fatalf("Failed to create test image: %v", err)
+	}
+
+	// vipr.im requires an account; the job must be rejected before any upload
+	job := JobRequest{
+		Action:  "upload",
+		Service: "vipr.im",
+		Files:   []string{tmpFile},
+		Creds:   map[string]string{"vipr_user": "user", "vipr_pass": "pass"},
+		Config:  map[string]string{"anonymous": "true"},
+	}
+
+	// Should not panic or attempt a login
+	handleJob(context.Background(), job)
+}
+
+// --- Result URL Validation Tests ---
+
+func TestValidateResultURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		url     string
+		thumb   string
+		wantErr bool
+	}{
+		{"imx ok", "imx.to", "https://imx.to/i/abc123", "https://image.imx.to/u/t/2024/01/01/abc.jpg", false},
+		{"pixhost ok", "pixhost.to", "https://pixhost.to/show/1/2_a.jpg", "https://t1.pixhost.to/thumbs/1/2_a.jpg", false},
+		{"pixhost error page", "pixhost.to", "https://pixhost.to/error", "https://t1.pixhost.to/thumbs/1/2_a.jpg", true},
+		{"vipr ok", "vipr.im", "https://vipr.im/i/abc/a.jpg.html", "https://vipr.im/th/abc/a.jpg", false},
+		{"turbo ok", "turboimagehost", "https://www.turboimagehost.com/p/123/a.jpg.html", "https://s8d3.turboimg.net/t1/123_a.jpg", false},
+		{"turbo wrong host thumb", "turboimagehost", "https://www.turboimagehost.com/p/123/a.jpg.html", "https://evil.example/t.jpg", true},
+		{"imagebam ok", "imagebam.com", "https://www.imagebam.com/view/ME1", "https://thumbs4.imagebam.com/a/b/ME1_t.jpg", false},
+		{"imagetwist ok", "imagetwist.com", "https://imagetwist.com/abc123/a.jpg", "https://img119.imagetwist.com/th/1/abc123.jpg", false},
+		{"postimages ok", "postimages.org", "https://postimg.cc/Xy12abCd", "https://i.postimg.cc/Xy12abCd/a.jpg", false},
+		{"postimages share page as thumb", "postimages.org", "https://postimg.cc/Xy12abCd", "https://postimg.cc/Xy12abCd", true},
+		{"relative path", "imx.to", "/i/abc123", "", true},
+		{"site root", "vipr.im", "https://vipr.im/", "", true},
+		{"empty url", "imx.to", "", "", true},
+		{"non-http scheme", "custom.host", "ftp://files.example/a.jpg", "", true},
+		{"unknown service absolute", "custom.host", "https://cdn.example/a.jpg", "https://cdn.example/t/a.jpg", false},
+		{"empty thumb allowed", "custom.host", "https://cdn.example/a.jpg", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateResultURLs(tt.service, tt.url, tt.thumb)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateResultURLs(%q, %q, %q) error = %v, wantErr %v", tt.service, tt.url, tt.thumb, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// --- Upload Scheduler Tests ---
+
+func TestUploadSchedulerInterleavesJobs(t *testing.T) {
+	s := newUploadScheduler(1)
+
+	var mu sync.Mutex
+	var order []string
+	record := func(fp string) {
+		mu.Lock()
+		order = append(order, fp)
+		mu.Unlock()
+	}
+
+	gate := make(chan struct{})
+	bigDone := make(chan struct{})
+	big := make([]string, 20)
+	for i := range big {
+		big[i] = fmt.Sprintf("big-%d", i)
+	}
+
+	go func() {
+		s.run("", big, 1, 1, func(fp string) {
+			if fp == "big-0" {
+				<-gate // hold the only worker until the small job is queued
+			}
+			record(fp)
+		})
+		close(bigDone)
+	}()
+
+	// Wait until big-0 is in flight, then queue the small job
+	for {
+		s.mu.Lock()
+		started := len(s.batches) == 1 && len(s.batches[0].pending) == 19
+		s.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	smallDone := make(chan struct{})
+	go func() {
+		s.run("", []string{"small-0", "small-1"}, 1, 1, record)
+		close(smallDone)
+	}()
+	for {
+		s.mu.Lock()
+		queued := len(s.batches) == 2
+		s.mu.Unlock()
+		if queued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+
+	<-smallDone
+	<-bigDone
+
+	lastSmall := -1
+	for i, fp := range order {
+		if strings.HasPrefix(fp, "small-") {
+			lastSmall = i
+		}
+	}
+	if len(order) != 22 {
+		t.Fatalf("processed %d files, want 22", len(order))
+	}
+	if lastSmall > 5 {
+		t.Errorf("small job finished at position %d, want it interleaved early; order = %v", lastSmall, order)
+	}
+}
+
+func TestUploadSchedulerRespectsMaxActive(t *testing.T) {
+	s := newUploadScheduler(8)
+
+	var mu sync.Mutex
+	active, peak := 0, 0
+	files := make([]string, 12)
+	for i := range files {
+		files[i] = fmt.Sprintf("f-%d", i)
+	}
+
+	s.run("", files, 1, 3, func(fp string) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})
+
+	if peak > 3 {
+		t.Errorf("peak concurrency = %d, want <= 3", peak)
+	}
+}
+
+func TestUploadSchedulerCappedBatchKeepsItsTurn(t *testing.T) {
+	s := &uploadScheduler{busy: map[string]int{}}
+	a := &uploadBatch{pending: []string{"a1", "a2", "a3", "a4"}, weight: 3, maxActive: 1}
+	b := &uploadBatch{pending: []string{"b1", "b2", "b3", "b4"}, weight: 2, maxActive: 4}
+	s.batches = []*uploadBatch{a, b}
+
+	var order []string
+	pick := func(releaseA bool) {
+		_, fp := s.pick()
+		order = append(order, fp)
+		if releaseA && strings.HasPrefix(fp, "a") {
+			a.active--
+		}
+	}
+	pick(false) // a1, then a is capped
+	pick(false) // b1
+	a.active--
+	pick(true) // b2 ends b's turn
+	pick(true) // a2
+	pick(true) // a3 ends a's turn of three
+	pick(true) // b3
+	want := []string{"a1", "b1", "b2", "a2", "a3", "b3"}
+	if !slices.Equal(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+}
+
+func TestUploadSchedulerGrowsForThreads(t *testing.T) {
+	s := newUploadScheduler(2)
+	var mu sync.Mutex
+	active, peak := 0, 0
+	release := make(chan struct{})
+	files := make([]string, 6)
+	for i := range files {
+		files[i] = fmt.Sprintf("f-%d", i)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.run("", files, 1, 6, func(fp string) {
+			mu.Lock()
+			active++
+			peak = max(peak, active)
+			mu.Unlock()
+			<-release
+		})
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := active
+		mu.Unlock()
+		if n == 6 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	<-done
+	if peak != 6 {
+		t.Errorf("peak concurrency = %d, want the 6 threads the job asked for", peak)
+	}
+
+	// The extra workers were for that job only; once idle the pool is back to its size
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		n := s.workers
+		s.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool still has %d workers after the job, want 2", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUploadSchedulerServiceLimit(t *testing.T) {
+	updateRateLimiter("limited.example", &RateLimitConfig{RequestsPerSecond: 100, BurstSize: 100, MaxConcurrent: 2})
+	t.Cleanup(func() {
+		rateLimiterMutex.Lock()
+		delete(concurrencyLimits, "limited.example")
+		delete(rateLimiters, "limited.example")
+		rateLimiterMutex.Unlock()
+	})
+	if n := jobThreads(&JobRequest{Service: "limited.example", Config: map[string]string{}}); n != 2 {
+		t.Errorf("jobThreads without threads = %d, want the service limit 2", n)
+	}
+
+	s := newUploadScheduler(8)
+	var mu sync.Mutex
+	active := map[string]int{}
+	peak := map[string]int{}
+	track := func(service string) func(string) {
+		return func(string) {
+			mu.Lock()
+			active[service]++
+			peak[service] = max(peak[service], active[service])
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			active[service]--
+			mu.Unlock()
+		}
+	}
+	files := make([]string, 8)
+	for i := range files {
+		files[i] = fmt.Sprintf("f-%d", i)
+	}
+	var wg sync.WaitGroup
+	for _, service := range []string{"limited.example", "limited.example", "other.example"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(service, files, 1, 4, track(service))
+		}()
+	}
+	wg.Wait()
+	// Two jobs of four threads each still share the service's two slots
+	if peak["limited.example"] > 2 {
+		t.Errorf("peak concurrency on the limited service = %d, want <= 2", peak["limited.example"])
+	}
+	if peak["other.example"] < 2 {
+		t.Errorf("peak concurrency on the other service = %d, want it unaffected", peak["other.example"])
+	}
+}
+
+func TestScheduleWeight(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 1},
+		{"abc", 1},
+		{"0", 1},
+		{"4", 4},
+		{"100000", MaxScheduleWeight},
+	}
+	for _, tt := range tests {
+		if got := scheduleWeight(map[string]string{"schedule_weight": tt.value}); got != tt.want {
+			t.Errorf("scheduleWeight(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+// --- Event Subscription Tests ---
+
+func TestEventFilterMatches(t *testing.T) {
+	f := &eventFilter{
+		Types:    []string{"result", "batch_complete"},
+		JobIDs:   []string{"job-a"},
+		Services: []string{"imx.to"},
+	}
+	tests := []struct {
+		name    string
+		ev      OutputEvent
+		service string
+		want    bool
+	}{
+		{"matching result", OutputEvent{Type: "result", JobID: "job-a"}, "imx.to", true},
+		{"filtered type", OutputEvent{Type: "progress", JobID: "job-a"}, "imx.to", false},
+		{"other job", OutputEvent{Type: "result", JobID: "job-b"}, "imx.to", false},
+		{"other service", OutputEvent{Type: "result", JobID: "job-a"}, "vipr.im", false},
+		{"sidecar-level event", OutputEvent{Type: "result"}, "", true},
+		{"error passes type filter", OutputEvent{Type: "error", JobID: "job-a"}, "imx.to", true},
+		{"error from other job", OutputEvent{Type: "error", JobID: "job-b"}, "imx.to", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.matches(tt.ev, tt.service); got != tt.want {
+				t.Errorf("matches(%+v, %q) = %v, want %v", tt.ev, tt.service, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscribeFiltersSubscriberOnly(t *testing.T) {
+	out := filepath.Join(useTempStateDir(t), "subscribers", "dashboard.jsonl")
+	defer handleUnsubscribe(JobRequest{Config: map[string]string{"subscriber": "dash"}})
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "subscribe", Config: map[string]string{"subscriber": "dash", "output": "dashboard.jsonl", "types": "result, batch_complete"}})
+		job := &JobRequest{ID: "sub-1", Service: "imx.to"}
+		sendJobEvent(job, OutputEvent{Type: "progress", FilePath: "a.jpg"})
+		sendJobEvent(job, OutputEvent{Type: "result", FilePath: "a.jpg", Url: "https://imx.to/i/a"})
+		sendJobEvent(job, OutputEvent{Type: "error", Msg: "boom"})
+		handleJob(context.Background(), JobRequest{Action: "subscribe", Config: map[string]string{"subscriber": "dash"}})
+		sendJobEvent(job, OutputEvent{Type: "progress", FilePath: "a.jpg"})
+	})
+
+	// stdout keeps the full stream
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	want := []string{"result", "progress", "result", "error", "result", "progress"}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Errorf("stdout event types = %v, want %v", types, want)
+	}
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types = nil
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var ev OutputEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("bad subscriber line %q: %v", line, err)
+		}
+		types = append(types, ev.Type)
+	}
+	// The subscriber sees its own acknowledgements, then only what its filter (plus errors) allows
+	want = []string{"result", "result", "error", "result", "progress"}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Errorf("subscriber event types = %v, want %v", types, want)
+	}
+}
+
+func TestSubscribeConfinesOutputToStateDir(t *testing.T) {
+	dir := useTempStateDir(t)
+	outside := filepath.Join(t.TempDir(), "events.jsonl")
+	for _, output := range []string{outside, "../events.jsonl", "sub/events.jsonl", ".."} {
+		events := captureEvents(t, func() {
+			handleJob(context.Background(), JobRequest{Action: "subscribe", Config: map[string]string{"subscriber": "escape", "output": output}})
+		})
+		if len(events) != 1 || events[0].Status != "failed" {
+			t.Errorf("output %q was accepted: %+v", output, events)
+		}
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Error("subscriber output was created outside the state dir")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "events.jsonl")); err == nil {
+		t.Error("subscriber output escaped the subscribers directory")
+	}
+}
+
+func TestSubscribeRequiresOutput(t *testing.T) {
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "subscribe", Config: map[string]string{"subscriber": "nobody"}})
+		handleJob(context.Background(), JobRequest{Action: "unsubscribe", Config: map[string]string{"subscriber": "nobody"}})
+	})
+	if len(events) != 2 || events[0].Status != "failed" || events[1].Status != "failed" {
+		t.Errorf("events = %+v", events)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList(" a, ,b,c ")
+	if strings.Join(got, "|") != "a|b|c" {
+		t.Errorf("splitList = %v", got)
+	}
+	if splitList("") != nil {
+		t.Error("splitList(\"\") should be nil")
+	}
+}
+
+// --- Throughput Mode Tests ---
+
+func TestPlanMultipartBatches(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) string {
+		fp := filepath.Join(dir, name)
+		if err := os.WriteFile(fp, make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return fp
+	}
+	a := write("a.jpg", 100)
+	b := write("b.jpg", 100)
+	big := write("big.jpg", SmallFileThreshold+1)
+	c := write("c.jpg", 100)
+	d := write("d.jpg", 100)
+	missing := filepath.Join(dir, "missing.jpg")
+
+	groups := planMultipartBatches([]string{a, b, big, c, d, missing}, 3, 1<<20)
+	var got []string
+	for _, g := range groups {
+		var names []string
+		for _, fp := range g {
+			names = append(names, filepath.Base(fp))
+		}
+		got = append(got, strings.Join(names, "+"))
+	}
+	want := "big.jpg|a.jpg+b.jpg+c.jpg|missing.jpg|d.jpg"
+	if strings.Join(got, "|") != want {
+		t.Errorf("groups = %v, want %s", got, want)
+	}
+
+	// Byte cap splits groups before the file cap is reached
+	groups = planMultipartBatches([]string{a, b, c}, 10, 250)
+	if len(groups) != 2 || len(groups[0]) != 2 {
+		t.Errorf("byte-capped groups = %v", groups)
+	}
+}
+
+func TestProcessBatchEmitsPerFileResults(t *testing.T) {
+	multipartBatchUploaders["batch.test"] = func(ctx context.Context, files []string, job *JobRequest) ([]batchResult, error) {
+		res := make([]batchResult, len(files))
+		for i, fp := range files {
+			res[i] = batchResult{url: "https://cdn.example/" + filepath.Base(fp), thumb: "https://cdn.example/t/" + filepath.Base(fp)}
+		}
+		return res, nil
+	}
+	defer delete(multipartBatchUploaders, "batch.test")
+
+	job := &JobRequest{Service: "batch.test", Config: map[string]string{}}
+	events := captureEvents(t, func() { processBatch(context.Background(), []string{"/tmp/a.jpg", "/tmp/b.jpg"}, job) })
+
+	results := map[string]string{}
+	for _, ev := range events {
+		if ev.Type == "result" {
+			results[ev.FilePath] = ev.Url
+		}
+	}
+	if results["/tmp/a.jpg"] != "https://cdn.example/a.jpg" || results["/tmp/b.jpg"] != "https://cdn.example/b.jpg" {
+		t.Errorf("unexpected results: %v", results)
+	}
+}
+
+func TestProcessBatchStoredFailureDoesNotReupload(t *testing.T) {
+	calls := 0
+	multipartBatchUploaders["batch.test"] = func(ctx context.Context, files []string, job *JobRequest) ([]batchResult, error) {
+		calls++
+		// The host stored the files but returned links that fail validation
+		return []batchResult{{url: "not a link"}, {url: "not a link"}}, nil
+	}
+	defer delete(multipartBatchUploaders, "batch.test")
+
+	job := &JobRequest{Service: "batch.test", Config: map[string]string{}}
+	events := captureEvents(t, func() { processBatch(context.Background(), []string{"/tmp/a.jpg", "/tmp/b.jpg"}, job) })
+
+	if calls != 1 {
+		t.Errorf("batch uploaded %d times, want 1", calls)
+	}
+	failed := map[string]bool{}
+	for _, ev := range events {
+		if ev.Type == "error" {
+			failed[ev.FilePath] = true
+		}
+		if ev.Type == "log" && strings.Contains(ev.Msg, "retrying individually") {
+			t.Error("a stored batch must not fall back to single-file uploads")
+		}
+	}
+	if !failed["/tmp/a.jpg"] || !failed["/tmp/b.jpg"] {
+		t.Errorf("expected a per-file error for each file, got %+v", events)
+	}
+}
+
+func TestThroughputMode(t *testing.T) {
+	if throughputMode(map[string]string{}) {
+		t.Error("throughput mode should be off by default")
+	}
+	if !throughputMode(map[string]string{"throughput_mode": "true"}) {
+		t.Error("throughput_mode=true should enable batching")
+	}
+	if n, b := batchLimits(map[string]string{"batch_max_files": "5", "batch_max_bytes": "bad"}); n != 5 || b != MaxBatchBytes {
+		t.Errorf("batchLimits = %d, %d", n, b)
+	}
+}
+
+// --- Referrer Policy Tests ---
+
+func TestReferrerPolicyFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		config  map[string]string
+		img     string
+		want    string
+	}{
+		{"default", "imx.to", map[string]string{}, "https://image.imx.to/u/t/a.jpg", DefaultReferrerPolicy},
+		{"host hint", "imagebam.com", map[string]string{}, "https://thumbs4.imagebam.com/a_t.jpg", "no-referrer"},
+		{"global config", "imx.to", map[string]string{"referrer_policy": "Origin"}, "https://image.imx.to/u/t/a.jpg", "origin"},
+		{"per-image-host config", "imx.to", map[string]string{"referrer_policy": "origin", "referrer_policy:image.imx.to": "no-referrer"}, "https://image.imx.to/u/t/a.jpg", "no-referrer"},
+		{"invalid config ignored", "imagebam.com", map[string]string{"referrer_policy": "bogus"}, "https://thumbs4.imagebam.com/a_t.jpg", "no-referrer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &JobRequest{Service: tt.service, Config: tt.config}
+			if got := referrerPolicyFor(job, tt.img); got != tt.want {
+				t.Errorf("referrerPolicyFor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultMetadataRefererCheck(t *testing.T) {
+	initHTTPClient()
+
+	// Serves the image only when no Referer is sent, like a hotlink-protected host
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "" {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<html>hotlinking not allowed</html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte{0xFF})
+	}))
+	defer server.Close()
+
+	job := &JobRequest{Service: "custom.host", Config: map[string]string{"referer_check": "true"}}
+	meta := resultMetadata(context.Background(), job, server.URL+"/t.jpg", server.URL+"/a.jpg")
+
+	if meta["referer_check_without"] != "ok" {
+		t.Errorf("referer_check_without = %q, want ok", meta["referer_check_without"])
+	}
+	if !strings.HasPrefix(meta["referer_check_with"], "blocked") {
+		t.Errorf("referer_check_with = %q, want blocked", meta["referer_check_with"])
+	}
+	if meta["referrer_policy"] != "no-referrer" || meta["referrer_policy_source"] != "probe" {
+		t.Errorf("unexpected policy metadata: %v", meta)
+	}
+
+	// Without the option no probes are made
+	job.Config = map[string]string{}
+	if meta := resultMetadata(context.Background(), job, server.URL+"/t.jpg", ""); len(meta) != 1 {
+		t.Errorf("expected only the policy hint, got %v", meta)
+	}
+}
+
+// --- Gallery Access Tests ---
+
+func TestGalleryAccessFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		config  map[string]string
+		wantErr bool
+		private bool
+	}{
+		{"unrestricted", "pixhost.to", map[string]string{}, false, false},
+		{"imx private", "imx.to", map[string]string{"gallery_private": "true"}, false, true},
+		{"private unsupported", "pixhost.to", map[string]string{"gallery_private": "1"}, true, true},
+		{"password unsupported", "imx.to", map[string]string{"gallery_password": "secret"}, true, false},
+		{"bad flag", "imx.to", map[string]string{"gallery_private": "maybe"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access, err := galleryAccessFromConfig(tt.service, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && access.private != tt.private {
+				t.Errorf("private = %v, want %v", access.private, tt.private)
+			}
+		})
+	}
+}
+
+func TestResultMetadataRecordsGalleryAccess(t *testing.T) {
+	job := &JobRequest{Service: "imx.to", Config: map[string]string{"gallery_id": "abc12", "gallery_private": "true"}}
+	meta := resultMetadata(context.Background(), job, "https://image.imx.to/u/t/a.jpg", "https://imx.to/i/a")
+	if meta["gallery_access"] != "private" || meta["gallery_url"] != "https://imx.to/g/abc12" {
+		t.Errorf("unexpected gallery metadata: %v", meta)
+	}
+
+	job.Config["gallery_private"] = "false"
+	if meta := resultMetadata(context.Background(), job, "https://image.imx.to/u/t/a.jpg", ""); meta["gallery_access"] != "" {
+		t.Errorf("public gallery should not record access details: %v", meta)
+	}
+}
+
+func TestHandleCreateGalleryRejectsUnsupportedPrivacy(t *testing.T) {
+	events := captureEvents(t, func() {
+		handleCreateGallery(context.Background(), JobRequest{Action: "create_gallery", Service: "pixhost.to", Config: map[string]string{"gallery_name": "x", "gallery_private": "true"}})
+	})
+	if len(events) != 1 || events[0].Status != "failed" || !strings.Contains(events[0].Msg, "private") {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+// --- Config Profile Tests ---
+
+// useSidecarConfig loads a config file written from content and restores the previous config afterwards
+func useSidecarConfig(t *testing.T, content string) {
+	t.Helper()
+	old := sidecarCfg
+	t.Cleanup(func() { sidecarCfg = old })
+
+	path := filepath.Join(t.TempDir(), "sidecar.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if err := loadSidecarConfig(path); err != nil {
+		t.Fatalf("loadSidecarConfig failed: %v", err)
+	}
+}
+
+func TestApplyConfigProfileMergesJobOverrides(t *testing.T) {
+	useSidecarConfig(t, `{"profiles": {"forum-A": {"threads": "4", "imx_thumb": "250", "schedule_weight": "2"}}}`)
+
+	job := &JobRequest{Config: map[string]string{"profile": "forum-A", "threads": "8"}}
+	if err := applyConfigProfile(job); err != nil {
+		t.Fatalf("applyConfigProfile failed: %v", err)
+	}
+	if job.Config["threads"] != "8" {
+		t.Errorf("job override lost: threads = %q", job.Config["threads"])
+	}
+	if job.Config["imx_thumb"] != "250" || job.Config["schedule_weight"] != "2" {
+		t.Errorf("profile values not merged: %v", job.Config)
+	}
+
+	job = &JobRequest{Config: map[string]string{"profile": "missing"}}
+	if err := applyConfigProfile(job); err == nil {
+		t.Error("unknown profile should be rejected")
+	}
+}
+
+func TestLoadSidecarConfigErrors(t *testing.T) {
+	if err := loadSidecarConfig(filepath.Join(t.TempDir(), "absent.json")); err != nil {
+		t.Errorf("missing config file should be ignored, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if err := loadSidecarConfig(path); err == nil {
+		t.Error("malformed config should fail to load")
+	}
+}
+
+func TestSidecarConfigYAMLReload(t *testing.T) {
+	oldCfg, oldPath, oldPool, oldLevel := sidecarCfg, sidecarConfigPath, jobWorkers, log.GetLevel()
+	t.Cleanup(func() {
+		sidecarCfg, sidecarConfigPath, jobWorkers = oldCfg, oldPath, oldPool
+		log.SetLevel(oldLevel)
+		rateLimiterMutex.Lock()
+		delete(rateLimiters, "reload.example")
+		rateLimiterMutex.Unlock()
+	})
+	spawned := 0
+	jobWorkers = &workerPool{spawn: func(int) { spawned++ }}
+	jobWorkers.resize(2)
+
+	sidecarConfigPath = filepath.Join(t.TempDir(), "sidecar.yaml")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(sidecarConfigPath, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	reload := func() OutputEvent {
+		t.Helper()
+		events := captureEvents(t, func() {
+			handleJob(context.Background(), JobRequest{ID: "reload-1", Action: "reload_config"})
+		})
+		if len(events) != 1 {
+			t.Fatalf("expected one event, got %+v", events)
+		}
+		return events[0]
+	}
+
+	writeConfig(`
+workers: 3
+log_level: debug
+defaults:
+  thumb: 180
+service_defaults:
+  imx.to:
+    imx_thumb: 300
+    imx_format: 2
+rate_limits:
+  reload.example:
+    requests_per_second: 4
+    burst_size: 2
+`)
+	if ev := reload(); ev.Type != "result" || ev.Status != "success" {
+		t.Fatalf("reload failed: %+v", ev)
+	}
+	if jobWorkers.workers() != 3 || spawned != 3 {
+		t.Errorf("pool not grown: size %d, spawned %d", jobWorkers.workers(), spawned)
+	}
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("log level = %s, want debug", log.GetLevel())
+	}
+	if limit := getRateLimiter("reload.example").Limit(); limit != 4 {
+		t.Errorf("rate limit = %v, want 4", limit)
+	}
+	job := &JobRequest{Service: "imx.to", Config: map[string]string{"imx_thumb": "250"}}
+	applyConfigDefaults(job)
+	want := map[string]string{"thumb": "180", "imx_thumb": "250", "imx_format": "2"}
+	if !maps.Equal(job.Config, want) {
+		t.Errorf("config = %v, want %v", job.Config, want)
+	}
+
+	writeConfig("workers: 1\n")
+	if ev := reload(); ev.Status != "success" {
+		t.Fatalf("reload failed: %+v", ev)
+	}
+	if !jobWorkers.retire() || !jobWorkers.retire() || jobWorkers.retire() {
+		t.Error("expected exactly two workers to retire after shrinking to 1")
+	}
+	if log.GetLevel() != log.InfoLevel {
+		t.Errorf("log level = %s, want info once the setting is removed", log.GetLevel())
+	}
+
+	// A file that fails to load leaves the running config alone
+	writeConfig("workers: 500\n")
+	if ev := reload(); ev.Type != "error" || !strings.Contains(ev.Msg, "workers") {
+		t.Errorf("expected a workers error, got %+v", ev)
+	}
+	if jobWorkers.workers() != 1 {
+		t.Errorf("pool resized by a rejected config: %d", jobWorkers.workers())
+	}
+}
+
+func TestLoadSidecarConfigTOML(t *testing.T) {
+	old := sidecarCfg
+	t.Cleanup(func() { sidecarCfg = old })
+
+	path := filepath.Join(t.TempDir(), "sidecar.toml")
+	content := "[profiles.forum-A]\nthreads = 4\nimx_thumb = \"250\"\nanonymous = true\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if err := loadSidecarConfig(path); err != nil {
+		t.Fatalf("loadSidecarConfig failed: %v", err)
+	}
+	want := configValues{"threads": "4", "imx_thumb": "250", "anonymous": "true"}
+	if got := sidecarCfg.Profiles["forum-A"]; !maps.Equal(got, want) {
+		t.Errorf("profile = %v, want %v", got, want)
+	}
+}
+
+// --- Job Template Tests ---
+
+func TestApplyJobTemplate(t *testing.T) {
+	useSidecarConfig(t, `{
+		"profiles": {"backup": {"threads": "1"}},
+		"templates": {"weekly-set": {
+			"service": "pixhost.to",
+			"config": {"profile": "backup", "pix_content": "adult"},
+			"gallery_name": "{folder} ({count} images)",
+			"post_template": "[b]{gallery_name}[/b]"
+		}}
+	}`)
+
+	job := &JobRequest{Action: "upload", Template: "weekly-set", Files: []string{"/photos/Beach Day/a.jpg", "/photos/Beach Day/b.jpg"}}
+	if err := applyJobTemplate(job); err != nil {
+		t.Fatalf("applyJobTemplate failed: %v", err)
+	}
+	if err := applyConfigProfile(job); err != nil {
+		t.Fatalf("applyConfigProfile failed: %v", err)
+	}
+	if job.Service != "pixhost.to" {
+		t.Errorf("service = %q, want pixhost.to", job.Service)
+	}
+	if job.Config["gallery_name"] != "Beach Day (2 images)" {
+		t.Errorf("gallery_name = %q", job.Config["gallery_name"])
+	}
+	if job.Config["threads"] != "1" || job.Config["pix_content"] != "adult" || job.Config["post_template"] == "" {
+		t.Errorf("template config not applied: %v", job.Config)
+	}
+
+	// Job-level values win over the template
+	job = &JobRequest{Template: "weekly-set", Service: "imx.to", Config: map[string]string{"gallery_name": "Mine"}}
+	if err := applyJobTemplate(job); err != nil {
+		t.Fatalf("applyJobTemplate failed: %v", err)
+	}
+	if job.Service != "imx.to" || job.Config["gallery_name"] != "Mine" {
+		t.Errorf("job overrides lost: service=%q config=%v", job.Service, job.Config)
+	}
+
+	if err := applyJobTemplate(&JobRequest{Template: "nope"}); err == nil {
+		t.Error("unknown template should be rejected")
+	}
+}
+
+// --- Host Plugin Tests ---
+
+// useHostPlugins loads plugin files written from contents and restores the previous plugins afterwards
+func useHostPlugins(t *testing.T, contents map[string]string) error {
+	t.Helper()
+	hostPluginsMutex.RLock()
+	old := hostPlugins
+	hostPluginsMutex.RUnlock()
+	t.Cleanup(func() {
+		hostPluginsMutex.Lock()
+		hostPlugins = old
+		hostPluginsMutex.Unlock()
+	})
+
+	dir := t.TempDir()
+	for name, content := range contents {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write plugin: %v", err)
+		}
+	}
+	return loadHostPlugins(dir)
+}
+
+const testPluginUpload = `"upload": {
+	"url": "%s/upload",
+	"multipart_fields": {"img": {"type": "file"}, "token": {"type": "dynamic", "value": "token"}, "size": {"type": "text", "value": "{config:thumb}"}},
+	"response_parser": {"type": "json", "url_path": "url", "thumb_path": "thumb", "status_path": "status", "success_value": "ok"}
+}`
+
+func TestLoadHostPlugins(t *testing.T) {
+	good := `{"service": "pics.example", ` + fmt.Sprintf(testPluginUpload, "https://pics.example") + `}`
+	err := useHostPlugins(t, map[string]string{
+		"good.json":     good,
+		"dup.json":      good,
+		"typo.json":     `{"service": "typo.example", "uplaod": {}}`,
+		"nofile.json":   `{"service": "nofile.example", "upload": {"url": "https://x", "response_parser": {"type": "json"}}}`,
+		"badregex.json": `{"service": "re.example", "login": {"url": "https://x", "extract_fields": {"t": "regex:("}}, ` + fmt.Sprintf(testPluginUpload, "https://x") + `}`,
+		"ignored.txt":   `not a plugin`,
+	})
+	if err == nil {
+		t.Fatal("expected errors for the broken plugins")
+	}
+	for _, name := range []string{"typo.json", "nofile.json", "badregex.json"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error does not name %s: %v", name, err)
+		}
+	}
+	// dup.json and good.json define the same service; whichever loads second is refused
+	if !strings.Contains(err.Error(), "already defined") {
+		t.Errorf("duplicate service not reported: %v", err)
+	}
+	p := lookupHostPlugin("pics.example")
+	if p == nil || p.Upload.Method != "POST" {
+		t.Fatalf("good plugin not registered: %+v", p)
+	}
+	if lookupHostPlugin("typo.example") != nil || lookupHostPlugin("re.example") != nil {
+		t.Error("broken plugins were registered")
+	}
+
+	if err := loadHostPlugins(filepath.Join(t.TempDir(), "absent")); err != nil {
+		t.Errorf("missing plugins directory should be ignored, got %v", err)
+	}
+}
+
+func TestLoadHostPluginsFromYAML(t *testing.T) {
+	err := useHostPlugins(t, map[string]string{
+		"pics.yaml": `service: yaml.example
+config:
+  thumb: 180
+  adult: false
+upload:
+  url: https://yaml.example/upload
+  multipart_fields:
+    img: {type: file}
+  response_parser: {type: json, url_path: url}
+`,
+		"typo.yml": "service: typo.example\nuplaod: {}\n",
+	})
+	if err == nil || !strings.Contains(err.Error(), "typo.yml") {
+		t.Errorf("misspelt YAML plugin not reported: %v", err)
+	}
+	p := lookupHostPlugin("yaml.example")
+	if p == nil || p.Upload.Method != "POST" || p.Upload.MultipartFields["img"].Type != "file" || p.Upload.ResponseParser.URLPath != "url" {
+		t.Fatalf("YAML plugin not registered: %+v", p)
+	}
+	if p.Config["thumb"] != "180" || p.Config["adult"] != "false" {
+		t.Errorf("YAML plugin config %v", p.Config)
+	}
+}
+
+func TestHostPluginUploadAndLogin(t *testing.T) {
+	initHTTPClient()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			if r.FormValue("user") != "me" || r.FormValue("pass") != "pw" {
+				_, _ = fmt.Fprint(w, `<html><body>bad login</body></html>`)
+				return
+			}
+			_, _ = fmt.Fprint(w, `<html><input name="token" value="t0k"></html>`)
+		case "/upload":
+			if r.FormValue("token") != "t0k" || r.FormValue("size") != "300" {
+				t.Errorf("unexpected form: token=%q size=%q", r.FormValue("token"), r.FormValue("size"))
+			}
+			_, _ = fmt.Fprint(w, `{"status": "ok", "url": "https://pics.example/i/1", "thumb": "https://pics.example/t/1.jpg"}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	plugin := `{
+		"service": "pics.example",
+		"login": {"url": "` + server.URL + `/login", "method": "POST", "form_fields": {"user": "{cred:pics_user}", "pass": "{cred:pics_pass}"},
+			"response_type": "html", "extract_fields": {"token": "input[name=token]"}},
+		"login_check": "token",
+		"config": {"thumb": "300", "threads": "1"},
+		` + fmt.Sprintf(testPluginUpload, server.URL) + `
+	}`
+	if err := useHostPlugins(t, map[string]string{"pics.json": plugin}); err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	creds := map[string]string{"pics_user": "me", "pics_pass": "pw"}
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "upload", Service: "pics.example", Files: []string{fp}, Creds: creds, Config: map[string]string{}})
+		handleJob(context.Background(), JobRequest{Action: "verify", Service: "pics.example", Files: []string{fp}, Creds: creds})
+		handleJob(context.Background(), JobRequest{Action: "verify", Service: "pics.example", Files: []string{fp}, Creds: map[string]string{"pics_user": "me"}})
+	})
+	var results []OutputEvent
+	for _, ev := range events {
+		if ev.Type == "result" {
+			results = append(results, ev)
+		}
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %+v", results)
+	}
+	if results[0].Url != "https://pics.example/i/1" || results[0].Thumb != "https://pics.example/t/1.jpg" {
+		t.Errorf("upload result = %+v", results[0])
+	}
+	if results[1].Status != "success" || results[2].Status != "failed" {
+		t.Errorf("login results = %+v, %+v", results[1], results[2])
+	}
+
+	// The plugin's own spec must not keep one job's credentials
+	if p := lookupHostPlugin("pics.example"); p.Login.FormFields["user"] != "{cred:pics_user}" {
+		t.Errorf("plugin spec was modified: %v", p.Login.FormFields)
+	}
+}
+
+// --- Batch Hook Tests ---
+
+func TestHttpUploadWarmUpAndCoolDown(t *testing.T) {
+	initHTTPClient()
+	var mu sync.Mutex
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/session":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "c1"})
+			_, _ = fmt.Fprint(w, `{"data": {"session": "s1", "csrf": "x9"}}`)
+		case "/upload/s1":
+			if c, err := r.Cookie("sid"); err != nil || c.Value != "c1" || r.Header.Get("X-CSRF-TOKEN") != "x9" || r.FormValue("session") != "s1" {
+				t.Errorf("upload did not carry the warm-up session: cookie=%v csrf=%q field=%q", c, r.Header.Get("X-CSRF-TOKEN"), r.FormValue("session"))
+			}
+			_, _ = fmt.Fprint(w, `{"url": "https://h.example/i/1", "thumb": "https://h.example/t/1"}`)
+		case "/finish/s1":
+			if r.FormValue("csrf") != "x9" {
+				t.Errorf("cool-down form = %v", r.Form)
+			}
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg")}
+	for _, fp := range files {
+		if err := createTestImage(fp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spec := &HttpRequestSpec{
+		URL:     server.URL + "/upload/{session}",
+		Method:  "POST",
+		Headers: map[string]string{"X-CSRF-TOKEN": "{csrf}"},
+		MultipartFields: map[string]MultipartField{
+			"file":    {Type: "file"},
+			"session": {Type: "dynamic", Value: "session"},
+		},
+		ResponseParser: ResponseParserSpec{Type: "json", URLPath: "url", ThumbPath: "thumb"},
+		WarmUp: &PreRequestSpec{URL: server.URL + "/session", Method: "POST", UseCookies: true, ResponseType: "json",
+			ExtractFields: map[string]string{"session": "data.session", "csrf": "data.csrf"}},
+		CoolDown: &PreRequestSpec{URL: server.URL + "/finish/{session}", Method: "POST", FormFields: map[string]string{"csrf": "{csrf}"}},
+	}
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "http_upload", Service: "hooks.example", Files: files, HttpSpec: spec, Config: map[string]string{"threads": "2"}})
+	})
+	results := 0
+	for _, ev := range events {
+		if ev.Type == "result" && ev.Url == "https://h.example/i/1" {
+			results++
+		}
+	}
+	if results != 2 {
+		t.Errorf("expected 2 results, got events %+v", events)
+	}
+	if len(calls) != 4 || calls[0] != "/session" || calls[3] != "/finish/s1" {
+		t.Errorf("hooks should wrap the batch once, got %v", calls)
+	}
+}
+
+func TestHttpUploadWarmUpFailureFailsBatch(t *testing.T) {
+	initHTTPClient()
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	spec := &HttpRequestSpec{
+		URL: server.URL + "/upload", Method: "POST",
+		MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+		ResponseParser:  ResponseParserSpec{Type: "json", URLPath: "url"},
+		WarmUp:          &PreRequestSpec{URL: server.URL + "/session", Method: "POST", ResponseType: "json"},
+		CoolDown:        &PreRequestSpec{URL: server.URL + "/finish", Method: "POST"},
+	}
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "http_upload", Service: "hooks.example", Files: []string{fp}, HttpSpec: spec})
+	})
+	var failed bool
+	for _, ev := range events {
+		if ev.Type == "error" && ev.FilePath == fp && strings.HasPrefix(ev.Msg, "Warm-up failed") {
+			failed = true
+		}
+	}
+	if !failed || events[len(events)-1].Type != "batch_complete" {
+		t.Errorf("expected the file to fail on warm-up, got %+v", events)
+	}
+	if len(calls) != 1 {
+		t.Errorf("nothing should follow a failed warm-up, got %v", calls)
+	}
+}
+
+// --- Mirror Upload Tests ---
+
+func TestUploadMirrorPolicies(t *testing.T) {
+	initHTTPClient()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			_, _ = fmt.Fprint(w, `{"url": "https://a.example/i/1", "thumb": "https://a.example/t/1"}`)
+		case "/b":
+			if r.FormValue("tag") != "b-only" {
+				t.Errorf("b.example should get its own tag, got %q", r.FormValue("tag"))
+			}
+			_, _ = fmt.Fprint(w, `{"url": "https://b.example/i/1"}`)
+		default:
+			http.Error(w, "gone", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	plugin := func(service, path string) string {
+		return fmt.Sprintf(`{"service": %q, "upload": {"url": "%s%s",
+			"multipart_fields": {"img": {"type": "file"}, "tag": {"type": "text", "value": "{config:tag}"}},
+			"response_parser": {"type": "json", "url_path": "url", "thumb_path": "thumb"}}}`, service, server.URL, path)
+	}
+	if err := useHostPlugins(t, map[string]string{
+		"a.json":    plugin("a.example", "/a"),
+		"b.json":    plugin("b.example", "/b"),
+		"down.json": plugin("down.example", "/down"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	run := func(config map[string]string) []OutputEvent {
+		config["tag"] = "shared"
+		config["b.example:tag"] = "b-only"
+		return captureEvents(t, func() {
+			handleJob(context.Background(), JobRequest{Action: "upload_mirror", Files: []string{fp}, Config: config,
+				RetryConfig: &RetryConfig{MaxRetries: 0}})
+		})
+	}
+	find := func(events []OutputEvent, typ string) *OutputEvent {
+		for i := range events {
+			if events[i].Type == typ && events[i].FilePath == fp {
+				return &events[i]
+			}
+		}
+		return nil
+	}
+
+	events := run(map[string]string{"mirror_services": "down.example, a.example, b.example"})
+	res := find(events, "result")
+	if res == nil || res.Url != "https://a.example/i/1" || res.Thumb != "https://a.example/t/1" || res.JobID == "" {
+		t.Fatalf("best effort should report the first host that worked, got %+v", events)
+	}
+	data, _ := res.Data.(map[string]interface{})
+	b, _ := data["b.example"].(map[string]interface{})
+	down, _ := data["down.example"].(map[string]interface{})
+	if len(data) != 3 || b["url"] != "https://b.example/i/1" || down["error"] == nil {
+		t.Errorf("unexpected per-host results: %+v", res.Data)
+	}
+
+	events = run(map[string]string{"mirror_services": "a.example,down.example", "mirror_policy": "all"})
+	if find(events, "result") != nil {
+		t.Errorf("all-must-succeed should not report a result, got %+v", events)
+	}
+	if ev := find(events, "error"); ev == nil || !strings.Contains(ev.Msg, "down.example") {
+		t.Errorf("expected an error naming the failed host, got %+v", events)
+	}
+
+	for _, config := range []map[string]string{{}, {"mirror_services": "a.example,a.example"}, {"mirror_services": "a.example", "mirror_policy": "most"}} {
+		events = run(config)
+		if len(events) == 0 || events[0].Type != "error" || !strings.HasPrefix(events[0].Msg, "Invalid job request") {
+			t.Errorf("config %v should be rejected, got %+v", config, events)
+		}
+	}
+}
+
+// --- Failover Tests ---
+
+func TestUploadFailsOverToNextHost(t *testing.T) {
+	initHTTPClient()
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		if r.URL.Path == "/ok" {
+			_, _ = fmt.Fprint(w, `{"url": "https://ok.example/i/1"}`)
+			return
+		}
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	plugin := func(service, path string) string {
+		return fmt.Sprintf(`{"service": %q, "upload": {"url": "%s%s", "multipart_fields": {"img": {"type": "file"}},
+			"response_parser": {"type": "json", "url_path": "url"}}}`, service, server.URL, path)
+	}
+	if err := useHostPlugins(t, map[string]string{
+		"down.json":  plugin("down.example", "/down"),
+		"down2.json": plugin("down2.example", "/down2"),
+		"ok.json":    plugin("ok.example", "/ok"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(fallbacks string) []OutputEvent {
+		calls = nil
+		return captureEvents(t, func() {
+			handleJob(context.Background(), JobRequest{Action: "upload", Service: "down.example", Files: []string{fp},
+				Config: map[string]string{"fallback_services": fallbacks}, RetryConfig: &RetryConfig{MaxRetries: 0}})
+		})
+	}
+
+	events := upload("down2.example,ok.example")
+	var result *OutputEvent
+	var fellBack int
+	for i, ev := range events {
+		switch {
+		case ev.Type == "result":
+			result = &events[i]
+		case ev.Type == "log" && strings.HasPrefix(ev.Msg, "Upload of a.jpg to "):
+			fellBack++
+		}
+	}
+	if result == nil || result.Url != "https://ok.example/i/1" {
+		t.Fatalf("expected the last host to take the file, got %+v", events)
+	}
+	if meta, _ := result.Data.(map[string]interface{}); meta["host"] != "ok.example" {
+		t.Errorf("result should name the host that succeeded, got %+v", result.Data)
+	}
+	if fellBack != 2 || strings.Join(calls, " ") != "/down /down2 /ok" {
+		t.Errorf("fallbacks = %d, calls = %v", fellBack, calls)
+	}
+
+	events = upload("down2.example")
+	for _, ev := range events {
+		if ev.Type == "result" {
+			t.Errorf("no host took the file, got %+v", ev)
+		}
+	}
+	if last := events[len(events)-1]; last.Type != "batch_complete" || len(calls) != 2 {
+		t.Errorf("expected both hosts to fail, calls = %v, events = %+v", calls, events)
+	}
+}
+
+// --- Scripted Host Tests ---
+
+const testChunkScript = `
+function login()
+	local r = host.request{url = host.config("base") .. "/login", form = {user = host.cred("s_user")}}
+	local token = host.match('"token":"([^"]+)"', r.body)
+	if not token then
+		return false, "no token"
+	end
+	return true, "token " .. token
+end
+
+function upload()
+	local size = host.file.size
+	local chunk = 100
+	local id = host.sha256(host.file.name .. size):sub(1, 8)
+	for offset = 0, size - 1, chunk do
+		local r = host.request{
+			method = "PUT",
+			url = host.config("base") .. "/chunk/" .. id .. "?offset=" .. offset,
+			headers = {["X-Sig"] = host.hmac_sha256(host.cred("s_key"), id .. offset)},
+			file = {offset = offset, length = chunk},
+		}
+		if r.status ~= 204 then
+			return nil, "chunk rejected: " .. r.status
+		end
+	end
+	print("sent", size, "bytes")
+	local done = host.json_decode(host.request{url = host.config("base") .. "/finish/" .. id, body = host.json_encode({name = host.file.name})}.body)
+	return done.url, done.thumb
+end
+`
+
+func TestScriptedHostChunkedUploadAndLogin(t *testing.T) {
+	initHTTPClient()
+	var got []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/login":
+			if r.FormValue("user") == "me" {
+				_, _ = fmt.Fprint(w, `{"token":"abc"}`)
+			}
+		case strings.HasPrefix(r.URL.Path, "/chunk/"):
+			id := strings.TrimPrefix(r.URL.Path, "/chunk/")
+			mac := hmac.New(sha256.New, []byte("k"))
+			mac.Write([]byte(id + r.URL.Query().Get("offset")))
+			if r.Header.Get("X-Sig") != hex.EncodeToString(mac.Sum(nil)) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			got = append(got, b...)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(r.URL.Path, "/finish/"):
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			_, _ = fmt.Fprintf(w, `{"url": "https://s.example/%s", "thumb": "https://s.example/t/%s"}`, body["name"], body["name"])
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	old := pluginsDir
+	pluginsDir = dir
+	t.Cleanup(func() { pluginsDir = old })
+	if err := os.WriteFile(filepath.Join(dir, "chunky.lua"), []byte(testChunkScript), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(dir, "a.bin")
+	data := bytes.Repeat([]byte("0123456789"), 25)
+	if err := os.WriteFile(fp, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	job := &JobRequest{Service: "scripted", Files: []string{fp}, Config: map[string]string{"script": "chunky.lua", "base": server.URL}, Creds: map[string]string{"s_user": "me", "s_key": "k"}}
+
+	var url, thumb string
+	var err error
+	events := captureEvents(t, func() { url, thumb, err = uploadScripted(context.Background(), fp, job) })
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if url != "https://s.example/a.bin" || thumb != "https://s.example/t/a.bin" || !bytes.Equal(got, data) {
+		t.Errorf("url=%q thumb=%q, server got %d bytes", url, thumb, len(got))
+	}
+	if len(events) != 1 || events[0].Msg != "[chunky] sent 250 bytes" {
+		t.Errorf("print should go to the job log, got %+v", events)
+	}
+
+	if ok, msg := verifyScriptLogin(context.Background(), job); !ok || msg != "token abc" {
+		t.Errorf("login = %v, %q", ok, msg)
+	}
+	job.Creds["s_user"] = "someone"
+	if ok, msg := verifyScriptLogin(context.Background(), job); ok || msg != "no token" {
+		t.Errorf("bad login = %v, %q", ok, msg)
+	}
+	job.Creds["s_key"] = "wrong"
+	if _, _, err := uploadScripted(context.Background(), fp, job); err == nil || !strings.Contains(err.Error(), "chunk rejected: 403") {
+		t.Errorf("expected the script's failure message, got %v", err)
+	}
+}
+
+func TestScriptedHostSandbox(t *testing.T) {
+	dir := t.TempDir()
+	old := pluginsDir
+	pluginsDir = dir
+	t.Cleanup(func() { pluginsDir = old })
+	script := `function upload() return tostring(os) .. tostring(io) .. tostring(dofile) .. tostring(require), nil end`
+	if err := os.WriteFile(filepath.Join(dir, "peek.lua"), []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &JobRequest{Service: "scripted", Config: map[string]string{"script": "peek.lua"}}
+	if url, _, err := uploadScripted(context.Background(), "", job); err != nil || url != "nilnilnilnil" {
+		t.Errorf("script could reach unsafe libraries: %q, %v", url, err)
+	}
+	for _, name := range []string{"", "../peek.lua"} {
+		job.Config["script"] = name
+		if _, _, err := uploadScripted(context.Background(), "", job); err == nil {
+			t.Errorf("script %q should be rejected", name)
+		}
+	}
+
+	// A runaway script stops when the job is cancelled
+	if err := os.WriteFile(filepath.Join(dir, "spin.lua"), []byte(`function upload() while true do end end`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	job.Config["script"] = "spin.lua"
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := uploadScripted(ctx, "", job); err == nil {
+		t.Error("expected the cancelled script to fail")
+	}
+}
+
+// --- Large File Tests ---
+
+func TestSplitLargeFiles(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.jpg")
+	big := filepath.Join(dir, "big.mp4")
+	if err := os.WriteFile(small, make([]byte, 10), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(big, make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	normal, large := splitLargeFiles([]string{small, big}, 50)
+	if len(normal) != 1 || normal[0] != small || len(large) != 1 || large[0] != big {
+		t.Errorf("normal = %v, large = %v", normal, large)
+	}
+	if normal, large := splitLargeFiles([]string{small, big}, 0); len(normal) != 2 || large != nil {
+		t.Errorf("threshold 0 should disable the large-file path, got %v / %v", normal, large)
+	}
+}
+
+func TestLargeFileConfig(t *testing.T) {
+	if got := largeFileThreshold(map[string]string{}); got != DefaultLargeFileThreshold {
+		t.Errorf("default threshold = %d", got)
+	}
+	if got := largeFileThreshold(map[string]string{"large_file_threshold": "0"}); got != 0 {
+		t.Errorf("threshold 0 = %d", got)
+	}
+	if got := configDuration(map[string]string{"stall_timeout": "30s"}, "stall_timeout", DefaultStallTimeout); got != 30*time.Second {
+		t.Errorf("stall_timeout = %s", got)
+	}
+	if got := configDuration(map[string]string{"stall_timeout": "soon"}, "stall_timeout", DefaultStallTimeout); got != DefaultStallTimeout {
+		t.Errorf("invalid duration should fall back, got %s", got)
+	}
+}
+
+func TestTransferMonitorProgressAndStall(t *testing.T) {
+	m := newTransferMonitor(100)
+	m.add(40)
+	now := time.Now()
+	if p := m.progress(now); p.BytesTransferred != 40 || p.Percentage != 40 {
+		t.Errorf("unexpected progress: %+v", p)
+	}
+	if m.stalled(now, time.Minute) {
+		t.Error("fresh transfer should not be stalled")
+	}
+	if !m.stalled(now.Add(2*time.Minute), time.Minute) {
+		t.Error("transfer idle past the limit should be stalled")
+	}
+
+	// Multipart framing pushes the body past the file size; a sent body is never stalled
+	m.add(80)
+	if p := m.progress(now); p.BytesTransferred != 100 {
+		t.Errorf("progress should be capped at the file size, got %d", p.BytesTransferred)
+	}
+	if m.stalled(now.Add(time.Hour), time.Minute) {
+		t.Error("a fully sent body should not count as stalled")
+	}
+
+	m.begin()
+	if p := m.progress(time.Now()); p.BytesTransferred != 0 {
+		t.Errorf("begin should reset the count, got %d", p.BytesTransferred)
+	}
+}
+
+func TestHttpClientForLargeFile(t *testing.T) {
+	initHTTPClient()
+	c := httpClientFor(withTransferMonitor(context.Background(), newTransferMonitor(1)))
+	if c.Timeout != 0 {
+		t.Errorf("large-file client should rely on its context deadline, got timeout %s", c.Timeout)
+	}
+	if c.Jar != client.Jar {
+		t.Error("large-file client should keep the session cookie jar")
+	}
+}
+
+func TestWatchTransferCancelsOnStall(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	m := newTransferMonitor(100)
+
+	events := captureEvents(t, func() {
+		watchTransfer(ctx, cancel, "/tmp/big.mp4", nil, m, time.Millisecond)
+	})
+	if !errors.Is(context.Cause(ctx), errUploadStalled) {
+		t.Errorf("expected stall cause, got %v", context.Cause(ctx))
+	}
+	if len(events) == 0 || events[0].Type != "progress" {
+		t.Errorf("expected a progress event before the stall, got %+v", events)
+	}
+}
+
+// drainTransport reads and discards request bodies, standing in for a host
+type drainTransport struct{}
+
+func (drainTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestCountingTransportIgnoresSideRequests(t *testing.T) {
+	useFreshUsage(t)
+	m := newTransferMonitor(1000)
+	ctx := withTransferMonitor(context.Background(), m)
+	rt := &countingTransport{base: drainTransport{}}
+
+	upload, _ := http.NewRequestWithContext(ctx, "POST", "https://example.com/upload", io.NopCloser(strings.NewReader(strings.Repeat("x", 600))))
+	upload.ContentLength = -1 // streamed like a multipart pipe
+	if _, err := rt.RoundTrip(upload); err != nil {
+		t.Fatal(err)
+	}
+	login, _ := http.NewRequestWithContext(ctx, "POST", "https://example.com/login", strings.NewReader("user=a"))
+	if _, err := rt.RoundTrip(login); err != nil {
+		t.Fatal(err)
+	}
+	if p := m.progress(time.Now()); p.BytesTransferred != 600 {
+		t.Errorf("a small side request should not reset or add to the transfer, got %d", p.BytesTransferred)
+	}
+}
+
+func TestHttpUploadRoutesLargeFiles(t *testing.T) {
+	initHTTPClient()
+	big := filepath.Join(t.TempDir(), "big.mp4")
+	if err := os.WriteFile(big, make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	job := JobRequest{
+		Action: "http_upload", Service: "example.test", Files: []string{big},
+		Config:      map[string]string{"large_file_threshold": "50", "large_file_timeout": "1s"},
+		HttpSpec:    &HttpRequestSpec{URL: "http://127.0.0.1:1/upload", Method: "POST"},
+		RetryConfig: &RetryConfig{MaxRetries: 0, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, BackoffMultiplier: 1},
+	}
+	events := captureEvents(t, func() { handleHttpUpload(context.Background(), job) })
+
+	var sawLargePath bool
+	for _, ev := range events {
+		if ev.Type == "log" && strings.Contains(ev.Msg, "using large-file path") {
+			sawLargePath = true
+		}
+	}
+	if !sawLargePath {
+		t.Error("http_upload should send large files through the large-file path")
+	}
+}
+
+func TestResultMetadataFeatureFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		config  map[string]string
+		thumb   string
+		want    map[string]string
+	}{
+		{"nothing requested", "imx.to", map[string]string{}, "t", map[string]string{}},
+		{"gallery and thumb used", "imx.to", map[string]string{"gallery_id": "g1", "imx_thumb_id": "180"}, "t",
+			map[string]string{"feature_gallery": "used", "feature_thumb_size": "used"}},
+		{"gallery unsupported", "fastpic.org", map[string]string{"gallery_id": "g1"}, "t",
+			map[string]string{"feature_gallery": "ignored"}},
+		{"host reads another gallery key", "pixhost.to", map[string]string{"gallery_id": "g1"}, "t",
+			map[string]string{"feature_gallery": "ignored"}},
+		{"no thumbnail returned", "imgur.com", map[string]string{"imgur_thumb": "m"}, "",
+			map[string]string{"feature_thumb_size": "ignored"}},
+		{"anonymous", "imgbox.com", map[string]string{"anonymous": "true"}, "t",
+			map[string]string{"feature_anonymous": "used"}},
+		{"unknown host", "s3", map[string]string{"gallery_id": "g1"}, "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := featureFlags(&JobRequest{Service: tt.service, Config: tt.config}, tt.thumb)
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("featureFlags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// --- Duplicate Upload Tests ---
+
+func TestInflightKey(t *testing.T) {
+	base := &JobRequest{Service: "imx.to", Config: map[string]string{"gallery_id": "g1"}, Creds: map[string]string{"imx_user": "u"}}
+	same := &JobRequest{Service: "imx.to", Config: map[string]string{"gallery_id": "g1", "output": "bbcode", "profile": "p"},
+		Creds: map[string]string{"imx_user": "u", "imx_pass": "other"}}
+	if inflightKey("/tmp/a.jpg", base) != inflightKey("/tmp/a.jpg", same) {
+		t.Error("unrelated config and creds must not make an upload distinct")
+	}
+	for name, job := range map[string]*JobRequest{
+		"gallery": {Service: "imx.to", Config: map[string]string{"gallery_id": "g2"}, Creds: base.Creds},
+		"thumb":   {Service: "imx.to", Config: map[string]string{"gallery_id": "g1", "imx_thumb_id": "600"}, Creds: base.Creds},
+		"account": {Service: "imx.to", Config: base.Config, Creds: map[string]string{"imx_user": "v"}},
+		"service": {Service: "pixhost.to", Config: base.Config, Creds: base.Creds},
+	} {
+		if inflightKey("/tmp/a.jpg", base) == inflightKey("/tmp/a.jpg", job) {
+			t.Errorf("a different %s must make the upload distinct", name)
+		}
+	}
+}
+
+// blockingUploadServer answers uploads only once release is closed, signalling started
+// as each request arrives
+func blockingUploadServer(t *testing.T) (srv *httptest.Server, started chan struct{}, release chan struct{}, calls *int32) {
+	started, release, calls = make(chan struct{}, 4), make(chan struct{}), new(int32)
+	var mu sync.Mutex
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*calls++
+		mu.Unlock()
+		_, _ = io.Copy(io.Discard, r.Body)
+		started <- struct{}{}
+		<-release
+		_, _ = io.WriteString(w, `{"url": "https://cdn.example/a.jpg"}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, started, release, calls
+}
+
+func runDuplicateUploads(t *testing.T, policy string) (events []OutputEvent, calls int32) {
+	initHTTPClient()
+	srv, started, release, n := blockingUploadServer(t)
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	job := func(id string) *JobRequest {
+		return &JobRequest{ID: id, Service: "plugin", Config: map[string]string{"duplicate_uploads": policy, "output": id},
+			RetryConfig: &RetryConfig{MaxRetries: 0},
+			HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST",
+				MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+				ResponseParser:  ResponseParserSpec{Type: "json", URLPath: "url"}}}
+	}
+	events = captureEvents(t, func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); processFile(context.Background(), fp, job("first")) }()
+		<-started
+		go func() { defer wg.Done(); processFile(context.Background(), fp, job("second")) }()
+		if policy != "" {
+			<-started
+		} else {
+			time.Sleep(50 * time.Millisecond) // let the second job find the first's upload
+		}
+		close(release)
+		wg.Wait()
+	})
+	return events, *n
+}
+
+func TestDuplicateUploadsCoalesce(t *testing.T) {
+	events, calls := runDuplicateUploads(t, "")
+	if calls != 1 {
+		t.Errorf("host received %d uploads, want 1", calls)
+	}
+	results := map[string]OutputEvent{}
+	for _, ev := range events {
+		if ev.Type == "result" {
+			results[ev.JobID] = ev
+		}
+	}
+	if len(results) != 2 || results["second"].Url != results["first"].Url {
+		t.Fatalf("both jobs should report the shared result, got %+v", results)
+	}
+	if meta, _ := results["second"].Data.(map[string]interface{}); meta["coalesced_with"] != "first" {
+		t.Errorf("second result should name the job it shared, got %+v", results["second"].Data)
+	}
+}
+
+func TestDuplicateUploadsWarnAndAllow(t *testing.T) {
+	for _, policy := range []string{"warn", "allow"} {
+		t.Run(policy, func(t *testing.T) {
+			events, calls := runDuplicateUploads(t, policy)
+			if calls != 2 {
+				t.Errorf("host received %d uploads, want 2", calls)
+			}
+			warned := false
+			for _, ev := range events {
+				if ev.Type == "log" && strings.Contains(ev.Msg, "is already being uploaded") {
+					warned = true
+				}
+			}
+			if warned != (policy == "warn") {
+				t.Errorf("warned = %v under %q", warned, policy)
+			}
+		})
+	}
+}
+
+func TestProcessBatchLeavesOutInflightFiles(t *testing.T) {
+	var batched []string
+	multipartBatchUploaders["batch.test"] = func(ctx context.Context, files []string, job *JobRequest) ([]batchResult, error) {
+		batched = files
+		res := make([]batchResult, len(files))
+		for i, fp := range files {
+			res[i] = batchResult{url: "https://cdn.example/" + filepath.Base(fp)}
+		}
+		return res, nil
+	}
+	defer delete(multipartBatchUploaders, "batch.test")
+
+	job := &JobRequest{ID: "second", Service: "batch.test", Config: map[string]string{}}
+	key := inflightKey("/tmp/a.jpg", job)
+	held, _ := inflight.claim(key, "first")
+	events := captureEvents(t, func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			processBatch(context.Background(), []string{"/tmp/a.jpg", "/tmp/b.jpg", "/tmp/c.jpg"}, job)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		inflight.finish(key, held, uploadOutcome{url: "https://cdn.example/shared.jpg"})
+		<-done
+	})
+
+	if strings.Join(batched, ",") != "/tmp/b.jpg,/tmp/c.jpg" {
+		t.Errorf("batch = %v, want the files no other job holds", batched)
+	}
+	for _, ev := range events {
+		if ev.Type == "result" && ev.FilePath == "/tmp/a.jpg" && ev.Url != "https://cdn.example/shared.jpg" {
+			t.Errorf("a.jpg should take the other job's result, got %+v", ev)
+		}
+	}
+}
+
+// --- Filename Transliteration Tests ---
+
+func TestTranslitProfileApply(t *testing.T) {
+	cases := []struct {
+		config map[string]string
+		in     string
+		want   string
+	}{
+		{map[string]string{}, "Фото 1.jpg", "Фото 1.jpg"},
+		{map[string]string{"translit": "cyrillic"}, "Щука и ЖУК.jpg", "Shchuka i ZHUK.jpg"},
+		{map[string]string{"translit": "cyrillic", "translit_scheme": "gost"}, "Щука Йод.jpg", "Shhuka Jod.jpg"},
+		{map[string]string{"translit": "diacritics"}, "Crème brûlée Straße.png", "Creme brulee Strasse.png"},
+		{map[string]string{"translit": "cjk"}, "きょうと カップ 서울.jpg", "kyouto kappu seoul.jpg"},
+		{map[string]string{"translit": "cjk"}, "東京.jpg", "東京.jpg"},
+		{map[string]string{"translit": "ascii"}, "東京 ラーメン.jpg", "u6771u4eac raamen.jpg"},
+		{map[string]string{"translit": "ascii", "translit_fallback": "drop"}, "東京.jpg", "file.jpg"},
+		{map[string]string{"translit": "cyrillic", "translit_hosts": "imx.to=off"}, "Фото.jpg", "Фото.jpg"},
+		{map[string]string{"translit_hosts": "pixhost.to=off, imx.to=cyrillic+diacritics"}, "Фото café.jpg", "Foto cafe.jpg"},
+	}
+	for _, tc := range cases {
+		p, err := translitProfileFor(&JobRequest{Service: "imx.to", Config: tc.config})
+		if err != nil {
+			t.Errorf("%v: %v", tc.config, err)
+			continue
+		}
+		if got := p.apply(tc.in); got != tc.want {
+			t.Errorf("%v: apply(%q) = %q, want %q", tc.config, tc.in, got, tc.want)
+		}
+	}
+
+	for _, bad := range []map[string]string{{"translit": "klingon"}, {"translit": "cyrillic", "translit_scheme": "x"}, {"translit_hosts": "imx.to"}} {
+		if _, err := translitProfileFor(&JobRequest{Service: "imx.to", Config: bad}); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
+
+func TestUploadSendsTransliteratedName(t *testing.T) {
+	initHTTPClient()
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, header, err := r.FormFile("file"); err == nil {
+			got = header.Filename
+		}
+		_, _ = io.WriteString(w, `{"url": "https://cdn.example/a.jpg"}`)
+	}))
+	defer srv.Close()
+	fp := filepath.Join(t.TempDir(), "Фото.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	job := &JobRequest{ID: "translit-1", Service: "plugin", Config: map[string]string{"translit": "ascii"},
+		RetryConfig: &RetryConfig{MaxRetries: 0},
+		HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST",
+			MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+			ResponseParser:  ResponseParserSpec{Type: "json", URLPath: "url"}}}
+	events := captureEvents(t, func() { processFile(context.Background(), fp, job) })
+	if got != "Foto.jpg" {
+		t.Errorf("host received file name %q, want Foto.jpg", got)
+	}
+	for _, ev := range events {
+		if ev.Type == "result" && ev.FilePath != fp {
+			t.Errorf("result should keep the local path, got %q", ev.FilePath)
+		}
+	}
+}
+
+// --- Image Orientation Tests ---
+
+func TestFormFileDisposition(t *testing.T) {
+	if got := formFileDisposition("file", `a "b".jpg`); got != `form-data; name="file"; filename="a \"b\".jpg"` {
+		t.Errorf("ASCII name: %s", got)
+	}
+	want := `form-data; name="file"; filename="Foto 1.jpg"; filename*=UTF-8''%D0%A4%D0%BE%D1%82%D0%BE%201.jpg`
+	if got := formFileDisposition("file", "Фото 1.jpg"); got != want {
+		t.Errorf("non-ASCII name:\n got %s\nwant %s", got, want)
+	}
+
+	// A reader that knows RFC 5987 gets the UTF-8 name back
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if _, err := createFormFile(mw, "file", "東京 café.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	_ = mw.Close()
+	part, err := multipart.NewReader(&buf, mw.Boundary()).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != "東京 café.jpg" {
+		t.Errorf("read back %q", part.FileName())
+	}
+}
+
+func TestParseOrientation(t *testing.T) {
+	cases := map[string]orientation{
+		"":                      {},
+		"90":                    {rotate: 90},
+		"270+vertical":          {rotate: 270, flip: "vertical"},
+		"180+180":               {},
+		"horizontal+vertical":   {rotate: 180},
+		"horizontal+horizontal": {},
+	}
+	for in, want := range cases {
+		if got, err := parseOrientation(in); err != nil || got != want {
+			t.Errorf("parseOrientation(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	if _, err := parseOrientation("45"); err == nil {
+		t.Error("expected an error for 45 degrees")
+	}
+}
+
+func TestOrientedFile(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "wide.png")
+	img := imaging.New(40, 20, color.White)
+	img.Set(0, 0, color.Black)
+	if err := imaging.Save(img, fp); err != nil {
+		t.Fatal(err)
+	}
+	notes := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(notes, []byte("text"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &JobRequest{Config: map[string]string{"rotate": "90", "orient_files": "other.png=180"}}
+	src, cleanup, err := preparedFile(fp, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := imaging.Open(src)
+	cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turned clockwise, the top-left corner ends up top-right
+	if b := got.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("rotated size = %v, want 20x40", b.Size())
+	}
+	if r, _, _, _ := got.At(19, 0).RGBA(); r != 0 {
+		t.Error("expected the black corner at the top right")
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("cleanup should remove the rotated copy")
+	}
+
+	// A job-wide rotation passes over files that are not images; a named one does not
+	if src, _, err := preparedFile(notes, job); err != nil || src != notes {
+		t.Errorf("preparedFile(notes) = %q, %v", src, err)
+	}
+	job.Config["orient_files"] = "notes.txt=90"
+	if _, _, err := preparedFile(notes, job); err == nil {
+		t.Error("expected an error rotating a text file by name")
+	}
+	job.Config["orient_files"] = "wide.png=none"
+	if src, _, err := preparedFile(fp, job); err != nil || src != fp {
+		t.Errorf("per-file none should override the job rotation, got %q, %v", src, err)
+	}
+}
+
+func TestUploadSendsRotatedImage(t *testing.T) {
+	initHTTPClient()
+	var name string
+	var size image.Point
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, header, err := r.FormFile("file"); err == nil {
+			name = header.Filename
+			if img, _, err := image.Decode(f); err == nil {
+				size = img.Bounds().Size()
+			}
+		}
+		_, _ = io.WriteString(w, `{"url": "https://cdn.example/a.jpg"}`)
+	}))
+	defer srv.Close()
+	fp := filepath.Join(t.TempDir(), "scan.jpg")
+	if err := imaging.Save(imaging.New(60, 30, color.White), fp); err != nil {
+		t.Fatal(err)
+	}
+	job := &JobRequest{ID: "orient-1", Service: "plugin", Config: map[string]string{"rotate": "270"},
+		RetryConfig: &RetryConfig{MaxRetries: 0},
+		HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST",
+			MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+			ResponseParser:  ResponseParserSpec{Type: "json", URLPath: "url"}}}
+	events := captureEvents(t, func() { processFile(context.Background(), fp, job) })
+	if name != "scan.jpg" || size != image.Pt(30, 60) {
+		t.Errorf("host received %q at %v, want scan.jpg at 30x60", name, size)
+	}
+	for _, ev := range events {
+		if ev.FilePath != "" && ev.FilePath != fp {
+			t.Errorf("%s event reported %q, want the local path", ev.Type, ev.FilePath)
+		}
+	}
+}
+
+// --- Image Normalization Tests ---
+
+func TestNormalizationFrom(t *testing.T) {
+	n, err := normalizationFrom(map[string]string{"normalize": "levels+sharpen"})
+	if err != nil || n != (normalization{levels: true, sharpen: true}) {
+		t.Errorf("normalizationFrom = %+v, %v", n, err)
+	}
+	if n.rewrites() != true || (normalization{sharpen: true}).rewrites() {
+		t.Error("only levels and srgb should rewrite the uploaded file")
+	}
+	if _, err := normalizationFrom(map[string]string{"normalize": "levels+vivid"}); err == nil {
+		t.Error("expected an error for an unknown step")
+	}
+}
+
+func TestAutoLevels(t *testing.T) {
+	// A washed-out scan: greys between 80 and 180 with a reddish patch
+	img := imaging.New(10, 10, color.NRGBA{R: 80, G: 80, B: 80, A: 255})
+	for x := 5; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			img.Set(x, y, color.NRGBA{R: 180, G: 180, B: 180, A: 255})
+		}
+	}
+	img.Set(0, 0, color.NRGBA{R: 160, G: 120, B: 120, A: 255})
+	out := imaging.Clone(autoLevels(img))
+	if c := out.NRGBAAt(1, 1); c.R != 0 {
+		t.Errorf("darkest tone = %v, want black", c)
+	}
+	if c := out.NRGBAAt(9, 9); c.R != 255 {
+		t.Errorf("lightest tone = %v, want white", c)
+	}
+	if c := out.NRGBAAt(0, 0); c.R <= c.G || c.G != c.B {
+		t.Errorf("reddish patch became %v, want it still red-tinted", c)
+	}
+
+	flat := imaging.New(4, 4, color.NRGBA{R: 90, G: 90, B: 90, A: 255})
+	if c := imaging.Clone(autoLevels(flat)).NRGBAAt(0, 0); c.R != 90 {
+		t.Errorf("flat image changed to %v", c)
+	}
+}
+
+func TestPreparedFileNormalizes(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "scan.png")
+	img := imaging.New(8, 8, color.NRGBA{R: 100, G: 100, B: 100, A: 255})
+	img.Set(0, 0, color.NRGBA{R: 150, G: 150, B: 150, A: 255})
+	if err := imaging.Save(img, fp); err != nil {
+		t.Fatal(err)
+	}
+	// Sharpening alone leaves the upload untouched
+	if src, _, err := preparedFile(fp, &JobRequest{Config: map[string]string{"normalize": "sharpen"}}); err != nil || src != fp {
+		t.Errorf("preparedFile with sharpen = %q, %v; want the original", src, err)
+	}
+
+	src, cleanup, err := preparedFile(fp, &JobRequest{Config: map[string]string{"normalize": "levels+srgb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	got, err := imaging.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := got.At(0, 0).RGBA(); r>>8 != 255 {
+		t.Errorf("lightest pixel = %d after levels, want 255", r>>8)
+	}
+}
+
+// --- Retry Policy Tests ---
+
+func TestRetryPolicy(t *testing.T) {
+	useSidecarConfig(t, `{"retry_policies": {"imx.to": {"retry_max": "5", "retry_base_delay": "2s", "retry_jitter": "0"}}}`)
+
+	p := retryPolicy(&JobRequest{Service: "imx.to", Config: map[string]string{"retry_max_delay": "1m"}})
+	if p.MaxRetries != 5 || p.InitialBackoff != 2*time.Second || p.MaxBackoff != time.Minute || p.Jitter == nil || *p.Jitter != 0 {
+		t.Errorf("imx.to policy = %+v", p)
+	}
+	// The job's config wins over the file, and the job's retry_config is the base
+	sent := &RetryConfig{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Second, BackoffMultiplier: 1}
+	p = retryPolicy(&JobRequest{Service: "pixhost.to", RetryConfig: sent, Config: map[string]string{"retry_max": "99"}})
+	if p.MaxRetries != MaxRetryCount || p.InitialBackoff != time.Millisecond || sent.MaxRetries != 1 {
+		t.Errorf("pixhost.to policy = %+v (sent %+v)", p, sent)
+	}
+	// A fallback host takes its own prefixed settings from the job
+	fallback := hostJob(&JobRequest{Service: "pixhost.to", Config: map[string]string{"retry_max": "2", "imx.to:retry_max": "0"}}, "imx.to")
+	if p := retryPolicy(fallback); p.MaxRetries != 0 || p.InitialBackoff != 2*time.Second {
+		t.Errorf("fallback policy = %+v", p)
+	}
+
+	if d := calculateBackoff(1, &RetryConfig{InitialBackoff: time.Second, MaxBackoff: time.Minute, BackoffMultiplier: 2, Jitter: new(float64)}); d != 2*time.Second {
+		t.Errorf("backoff without jitter = %s, want 2s", d)
+	}
+}
+
+func TestIsRetryableErrorPermanent(t *testing.T) {
+	config := getDefaultRetryConfig()
+	tests := []struct {
+		err  string
+		code int
+		want bool
+	}{
+		{"upload failed: HTTP 503", 503, true},
+		{"read tcp: connection reset by peer", 0, true},
+		{"upload failed: HTTP 401", 401, false},
+		{"upload failed: HTTP 413", 413, false},
+		{"imgur: Invalid API key (unexpected EOF in body)", 0, false},
+		{"host says: file too large, timeout reading rest", 0, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableError(errors.New(tt.err), tt.code, config); got != tt.want {
+			t.Errorf("isRetryableError(%q, %d) = %v, want %v", tt.err, tt.code, got, tt.want)
+		}
+	}
+	// A code the policy lists as retryable is retried even if it is usually permanent
+	config.RetryableHTTPCodes = append(config.RetryableHTTPCodes, 403)
+	if !isRetryableError(errors.New("HTTP 403"), 403, config) {
+		t.Error("an explicitly retryable 403 was not retried")
+	}
+}
+
+// --- Circuit Breaker Tests ---
+
+func TestHostBreakerTrips(t *testing.T) {
+	var s breakerSet
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if opened, _ := s.record("h", true, 3, time.Minute, now); opened {
+			t.Fatalf("opened after %d failures, want 3", i+1)
+		}
+	}
+	if opened, _ := s.record("h", true, 3, time.Minute, now); !opened {
+		t.Fatal("expected the third failure to open the breaker")
+	}
+	if err := s.admit("h", now.Add(30*time.Second)); !errors.Is(err, errHostDown) {
+		t.Fatalf("admit during cooldown = %v, want errHostDown", err)
+	}
+	if err := s.admit("other", now); err != nil {
+		t.Errorf("another host was refused: %v", err)
+	}
+
+	// After the cooldown one trial goes through and the rest wait for it
+	later := now.Add(2 * time.Minute)
+	if err := s.admit("h", later); err != nil {
+		t.Fatalf("trial refused: %v", err)
+	}
+	if err := s.admit("h", later); !errors.Is(err, errHostDown) {
+		t.Error("a second upload went through beside the trial")
+	}
+	if opened, _ := s.record("h", true, 3, time.Minute, later); opened {
+		t.Error("a failed trial should reopen quietly, not report a new outage")
+	}
+	if err := s.admit("h", later.Add(30*time.Second)); !errors.Is(err, errHostDown) {
+		t.Error("a failed trial should start a new cooldown")
+	}
+	_ = s.admit("h", later.Add(2*time.Minute))
+	if _, recovered := s.record("h", false, 3, time.Minute, later.Add(2*time.Minute)); !recovered {
+		t.Error("a successful trial should close the breaker")
+	}
+	if err := s.admit("h", later.Add(2*time.Minute)); err != nil {
+		t.Errorf("closed breaker refused an upload: %v", err)
+	}
+}
+
+func TestHttpUploadFailsFastWhenHostIsDown(t *testing.T) {
+	useTempStateDir(t)
+	initHTTPClient()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 5; i++ {
+		fp := filepath.Join(dir, fmt.Sprintf("%d.jpg", i))
+		if err := createTestImage(fp); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fp)
+	}
+	job := JobRequest{
+		ID: "breaker-1", Action: "http_upload", Service: "down.example", Files: files,
+		Config:      map[string]string{"threads": "1", "breaker_threshold": "2"},
+		HttpSpec:    &HttpRequestSpec{URL: srv.URL, Method: "POST", MultipartFields: map[string]MultipartField{"file": {Type: "file"}}},
+		RetryConfig: &RetryConfig{MaxRetries: 0},
+	}
+	events := captureEvents(t, func() { handleHttpUpload(context.Background(), job) })
+
+	if n := hits.Load(); n != 2 {
+		t.Errorf("host was sent %d uploads, want 2 before the breaker opened", n)
+	}
+	var down, fastFails int
+	for _, ev := range events {
+		switch {
+		case ev.Type == "host_down" && ev.Status == "down.example":
+			down++
+		case ev.Type == "error" && strings.Contains(ev.Msg, "host down"):
+			fastFails++
+		}
+	}
+	if down != 1 || fastFails != 3 {
+		t.Errorf("got %d host_down events and %d fast failures, want 1 and 3", down, fastFails)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"Wed, 01 May 2024 11:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.in, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHttpUploadHonoursRetryAfter(t *testing.T) {
+	useTempStateDir(t)
+	old := client
+	client = &http.Client{Transport: &countingTransport{base: http.DefaultTransport}}
+	t.Cleanup(func() { client = old })
+	var hits atomic.Int32
+	var first time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		if since := time.Since(first); since < 900*time.Millisecond {
+			t.Errorf("retried after %v, before the host's Retry-After", since)
+		}
+		_, _ = io.WriteString(w, `{"url":"https://throttle.example/a.jpg"}`)
+	}))
+	defer srv.Close()
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	job := JobRequest{
+		ID: "throttle-1", Action: "http_upload", Service: "throttle.example", Files: []string{fp},
+		HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST", MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+			ResponseParser: ResponseParserSpec{Type: "json", URLPath: "url"}},
+		// The policy alone would retry at once, and would not retry a 429 at all
+		RetryConfig: &RetryConfig{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, BackoffMultiplier: 1},
+	}
+	events := captureEvents(t, func() { handleHttpUpload(context.Background(), job) })
+
+	if n := hits.Load(); n != 2 {
+		t.Errorf("host was sent %d uploads, want 2", n)
+	}
+	if !slices.ContainsFunc(events, func(ev OutputEvent) bool {
+		return ev.Type == "status" && ev.Status == "Throttled" && ev.FilePath == fp
+	}) {
+		t.Error("expected a Throttled status event for the file")
+	}
+	if !slices.ContainsFunc(events, func(ev OutputEvent) bool { return ev.Type == "result" && ev.Url == "https://throttle.example/a.jpg" }) {
+		t.Error("expected the upload to succeed after the wait")
+	}
+}
+
+func TestHeartbeatLoop(t *testing.T) {
+	stop := make(chan struct{})
+	events := captureEvents(t, func() {
+		done := make(chan struct{})
+		go func() {
+			heartbeatLoop(stop, 10*time.Millisecond, func() int { return 4 }, func() int { return 7 })
+			close(done)
+		}()
+		time.Sleep(55 * time.Millisecond)
+		close(stop)
+		<-done
+	})
+	var beats []heartbeat
+	for _, ev := range events {
+		if ev.Type != "heartbeat" {
+			continue
+		}
+		b, _ := json.Marshal(ev.Data)
+		var hb heartbeat
+		if err := json.Unmarshal(b, &hb); err != nil {
+			t.Fatal(err)
+		}
+		beats = append(beats, hb)
+	}
+	if len(beats) < 2 {
+		t.Fatalf("got %d heartbeats, want several", len(beats))
+	}
+	for i, hb := range beats {
+		if hb.Seq != i+1 || hb.QueueDepth != 7 || hb.Workers != 4 {
+			t.Errorf("heartbeat %d = %+v", i, hb)
+		}
+	}
+
+	// Disabled heartbeats return at once
+	heartbeatLoop(make(chan struct{}), 0, func() int { return 4 }, func() int { return 0 })
+}
+
+func TestUploadsInFlightCounted(t *testing.T) {
+	useTempStateDir(t)
+	initHTTPClient()
+	var during atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		during.Store(uploadsInFlight.Load())
+		_, _ = io.WriteString(w, `{"url":"https://inflight.example/a.jpg"}`)
+	}))
+	defer srv.Close()
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	before := uploadsInFlight.Load()
+	job := JobRequest{
+		Action: "http_upload", Service: "inflight.example", Files: []string{fp},
+		HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST", MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+			ResponseParser: ResponseParserSpec{Type: "json", URLPath: "url"}},
+	}
+	captureEvents(t, func() { handleHttpUpload(context.Background(), job) })
+	if n := during.Load(); n != before+1 {
+		t.Errorf("%d uploads in flight during the upload, want %d", n, before+1)
+	}
+	if n := uploadsInFlight.Load(); n != before {
+		t.Errorf("%d uploads in flight afterwards, want %d", n, before)
+	}
+}
+
+func TestOCRTags(t *testing.T) {
+	got := ocrTags("The Annual REPORT 2023\n\nannual report — for the Board, page 1 of 12; Zürich")
+	want := []string{"annual", "report", "2023", "board", "page", "zürich"}
+	if !slices.Equal(got, want) {
+		t.Errorf("ocrTags = %v, want %v", got, want)
+	}
+}
+
+func TestUploadRecordsOCRTagsInHistory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake tesseract is a shell script")
+	}
+	useTempStateDir(t)
+	initHTTPClient()
+	dir := t.TempDir()
+	tesseract := filepath.Join(dir, "tesseract")
+	// Slower than the upload timeout below: OCR starts after the result, outside it
+	script := "#!/bin/sh\n[ \"$2\" = stdout ] && [ \"$4\" = deu ] || exit 1\nsleep 0.3\necho 'Quarterly Figures'\necho 'page one'\n"
+	if err := os.WriteFile(tesseract, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	useSidecarConfig(t, fmt.Sprintf(`{"tesseract_path": %q}`, tesseract))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"url":"https://ocr.example/a.jpg"}`)
+	}))
+	defer srv.Close()
+	var files []string
+	for _, name := range []string{"cover.jpg", "p2.jpg"} {
+		fp := filepath.Join(dir, name)
+		if err := createTestImage(fp); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fp)
+	}
+	job := JobRequest{
+		ID: "ocr-1", Action: "http_upload", Service: "ocr.example", Files: files,
+		Config: map[string]string{"ocr": "first", "ocr_lang": "deu", "threads": "1"},
+		HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST", MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+			ResponseParser: ResponseParserSpec{Type: "json", URLPath: "url"}},
+	}
+	events := captureEvents(t, func() { handleHttpUpload(context.Background(), job) })
+	tagged := map[string]string{}
+	for _, ev := range events {
+		data, _ := ev.Data.(map[string]interface{})
+		switch ev.Type {
+		case "result":
+			if pending := data["ocr"] == "pending"; pending != (ev.FilePath == files[0]) {
+				t.Errorf("%s result data %v", filepath.Base(ev.FilePath), data)
+			}
+		case "tags":
+			tagged[ev.FilePath], _ = data["tags"].(string)
+		}
+	}
+	if len(tagged) != 1 || tagged[files[0]] != "quarterly,figures,page,one" {
+		t.Errorf("tags events %v", tagged)
+	}
+
+	entries, err := readHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("history holds %d entries, want 2", len(entries))
+	}
+	for _, e := range entries {
+		if e.JobID != "ocr-1" || e.Service != "ocr.example" || e.Url != "https://ocr.example/a.jpg" {
+			t.Errorf("history entry %+v", e)
+		}
+		if e.File == files[0] && !slices.Equal(e.Tags, []string{"quarterly", "figures", "page", "one"}) {
+			t.Errorf("cover recorded with tags %v", e.Tags)
+		}
+	}
+
+	// The upload is done before OCR outlasts its timeout, so it is neither failed nor repeated
+	var outcome uploadOutcome
+	events = captureEvents(t, func() {
+		outcome = uploadFileOnce(context.Background(), files[0], &job, 100*time.Millisecond, nil, 0)
+	})
+	var results int
+	for _, ev := range events {
+		if ev.Type == "result" {
+			results++
+		} else if ev.Type == "error" {
+			t.Errorf("upload failed: %s", ev.Msg)
+		}
+	}
+	if results != 1 || outcome.err != "" || outcome.meta["tags"] != "quarterly,figures,page,one" {
+		t.Errorf("%d results, outcome %+v", results, outcome)
+	}
+}
+
+func TestHistorySearch(t *testing.T) {
+	useTempStateDir(t)
+	trip := &JobRequest{ID: "trip", Service: "imgbox.com", Config: map[string]string{"title": "Lisbon Trip", "tags": "travel, 2024"}}
+	work := &JobRequest{ID: "work", Service: "pixhost.to", Config: map[string]string{"tags": "work"}}
+	recordHistory(trip, OutputEvent{FilePath: "/pics/tram.jpg", Url: "https://imgbox.example/1"})
+	recordHistory(trip, OutputEvent{FilePath: "/pics/beach.jpg", Url: "https://imgbox.example/2"})
+	recordHistory(work, OutputEvent{FilePath: "/scans/invoice.png", Url: "https://pixhost.example/3", Data: map[string]string{"tags": "invoice,total"}})
+
+	search := func(config map[string]string) (names []string, status string) {
+		events := captureEvents(t, func() {
+			handleJob(context.Background(), JobRequest{Action: "history_search", Config: config})
+		})
+		if len(events) != 1 {
+			t.Fatalf("history_search %v sent %d events", config, len(events))
+		}
+		entries, _ := events[0].Data.([]interface{})
+		for _, e := range entries {
+			names = append(names, filepath.Base(fmt.Sprint(e.(map[string]interface{})["file"])))
+		}
+		return names, events[0].Status
+	}
+	today := time.Now().Format("2006-01-02")
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	for _, tc := range []struct {
+		config map[string]string
+		want   []string
+	}{
+		{map[string]string{}, []string{"invoice.png", "beach.jpg", "tram.jpg"}},
+		{map[string]string{"tags": "TRAVEL"}, []string{"beach.jpg", "tram.jpg"}},
+		{map[string]string{"tags": "travel,work"}, nil},
+		{map[string]string{"tags": "invoice"}, []string{"invoice.png"}}, // OCR tags count too
+		{map[string]string{"service": "imgbox.com", "file": "TRAM"}, []string{"tram.jpg"}},
+		{map[string]string{"title": "lisbon", "limit": "1"}, []string{"beach.jpg"}},
+		{map[string]string{"from": today, "to": today}, []string{"invoice.png", "beach.jpg", "tram.jpg"}},
+		{map[string]string{"from": tomorrow}, nil},
+	} {
+		if got, _ := search(tc.config); !slices.Equal(got, tc.want) {
+			t.Errorf("history_search %v = %v, want %v", tc.config, got, tc.want)
+		}
+	}
+	if _, status := search(map[string]string{"to": "last week"}); status != "failed" {
+		t.Errorf("an unparseable date was accepted")
+	}
+}
+
+func TestBatchFeed(t *testing.T) {
+	useTempStateDir(t)
+	done := &JobRequest{ID: "feed-done", Service: "imx.to", Config: map[string]string{"title": "Autumn <set>"}}
+	recordHistory(done, OutputEvent{FilePath: "/p/1.jpg", Url: "https://imx.example/i/1", Data: map[string]string{"gallery_url": "https://imx.to/g/42"}})
+	recordHistory(done, OutputEvent{FilePath: "/p/2.jpg", Url: "https://imx.example/i/2"})
+	running := &JobRequest{ID: "feed-running", Action: "upload", Service: "imx.to", Files: []string{"/p/3.jpg", "/p/4.jpg"}}
+	if _, err := jobs.register(running); err != nil { // queued, so not yet in the feed
+		t.Fatal(err)
+	}
+	recordHistory(running, OutputEvent{FilePath: "/p/3.jpg", Url: "https://imx.example/i/3"})
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		handleFeed(w, httptest.NewRequest("GET", "http://feeds.local"+path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d", path, w.Code)
+		}
+		return w.Body.String()
+	}
+	atom := get("/feed.atom")
+	for _, want := range []string{
+		`<feed xmlns="http://www.w3.org/2005/Atom">`,
+		"<title>Autumn &lt;set&gt;</title>",
+		`<link href="https://imx.to/g/42"></link>`,
+		"2 file(s) on imx.to&#xA;Gallery: https://imx.to/g/42&#xA;https://imx.example/i/1&#xA;https://imx.example/i/2",
+	} {
+		if !strings.Contains(atom, want) {
+			t.Errorf("Atom feed lacks %q:\n%s", want, atom)
+		}
+	}
+	if strings.Contains(atom, "feed-running") {
+		t.Error("Atom feed lists a batch that is still running")
+	}
+	if rss := get("/feed.rss"); !strings.Contains(rss, `<rss version="2.0">`) || !strings.Contains(rss, "<guid>batch:feed-done</guid>") {
+		t.Errorf("RSS feed:\n%s", rss)
+	}
+}
+
+func TestHistoryQueryFindsFileByContent(t *testing.T) {
+	useTempStateDir(t)
+	dir := t.TempDir()
+	original := filepath.Join(dir, "IMG_0001.jpg")
+	other := filepath.Join(dir, "IMG_0002.jpg")
+	if err := os.WriteFile(original, []byte("sunset"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, []byte("harbour"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	job := &JobRequest{ID: "hq-1", Service: "imgbox.com"}
+	recordHistory(job, OutputEvent{FilePath: original, Url: "https://imgbox.example/sunset", Thumb: "https://imgbox.example/t/sunset"})
+	recordHistory(job, OutputEvent{FilePath: other, Url: "https://imgbox.example/harbour"})
+
+	// The user renamed the picture since; its content still finds the upload
+	renamed := filepath.Join(dir, "sunset-final.jpg")
+	if err := os.Rename(original, renamed); err != nil {
+		t.Fatal(err)
+	}
+	query := func(config map[string]string) OutputEvent {
+		events := captureEvents(t, func() {
+			handleJob(context.Background(), JobRequest{Action: "history_query", Config: config})
+		})
+		if len(events) != 1 {
+			t.Fatalf("history_query %v sent %d events", config, len(events))
+		}
+		return events[0]
+	}
+	ev := query(map[string]string{"path": renamed})
+	found, _ := ev.Data.([]interface{})
+	if len(found) != 1 {
+		t.Fatalf("history_query by path found %v", ev.Data)
+	}
+	e := found[0].(map[string]interface{})
+	sum := sha256.Sum256([]byte("sunset"))
+	if e["url"] != "https://imgbox.example/sunset" || e["thumb"] != "https://imgbox.example/t/sunset" || e["hash"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("history_query by path found %v", e)
+	}
+
+	if found, _ := query(map[string]string{"hash": strings.ToUpper(hex.EncodeToString(sum[:]))}).Data.([]interface{}); len(found) != 1 {
+		t.Errorf("history_query by hash found %d entries, want 1", len(found))
+	}
+	if ev := query(map[string]string{"path": filepath.Join(dir, "missing.jpg")}); ev.Status != "failed" {
+		t.Errorf("history_query of a missing file: %+v", ev)
+	}
+}
+
+func TestHistoryIndexReadsOnlyAppendedLines(t *testing.T) {
+	useTempStateDir(t)
+	a := &JobRequest{ID: "ix-a", Service: "imgbox.com"}
+	recordHistory(a, OutputEvent{FilePath: "/p/1.jpg", Url: "https://imgbox.example/1"})
+	if entries, err := readHistory(); err != nil || len(entries) != 1 {
+		t.Fatalf("readHistory = %v, %v", entries, err)
+	}
+	offset := historyLog.offset
+
+	// Another writer's torn line is left until it is complete
+	f, err := os.OpenFile(historyPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := json.Marshal(historyEntry{JobID: "ix-b", Service: "imgbox.com", File: "/p/2.jpg", Hash: "abc", Url: "https://imgbox.example/2"})
+	if _, err := f.Write(line[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := historyByJob("ix-b"); len(entries) != 0 || historyLog.offset != offset {
+		t.Errorf("torn line read as %v (offset %d, was %d)", entries, historyLog.offset, offset)
+	}
+	if _, err := f.Write(append(line[10:], '\n')); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if entries, _ := historyByHash("abc"); len(entries) != 1 || entries[0].JobID != "ix-b" {
+		t.Errorf("historyByHash = %v", entries)
+	}
+	if entries, _ := historyByJob("ix-a"); len(entries) != 1 || entries[0].Url != "https://imgbox.example/1" {
+		t.Errorf("historyByJob = %v", entries)
+	}
+
+	// A file replaced by a shorter one is read again
+	if err := os.WriteFile(historyPath(), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := readHistory(); len(entries) != 0 {
+		t.Errorf("readHistory after truncation = %v", entries)
+	}
+}
+
+func TestSpriteSheet(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, f := range []struct {
+		name string
+		h    int
+	}{{"a.jpg", 100}, {"b.png", 50}, {"c.jpg", 100}} {
+		fp := filepath.Join(dir, f.name)
+		if err := imaging.Save(imaging.New(100, f.h, color.NRGBA{R: 200, A: 255}), fp); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fp)
+	}
+	out := filepath.Join(dir, "out", "set.jpg")
+	if err := os.Mkdir(filepath.Dir(out), 0700); err != nil {
+		t.Fatal(err)
+	}
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "sprite_sheet", Files: files, Config: map[string]string{"width": "50", "columns": "2", "path": out}})
+	})
+	if len(events) != 1 || events[0].Status != "success" {
+		t.Fatalf("sprite_sheet sent %+v", events)
+	}
+
+	sheet, err := imaging.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := sheet.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+		t.Errorf("sheet is %dx%d, want 100x100 (two 50px columns, rows as tall as their tallest thumbnail)", b.Dx(), b.Dy())
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "out", "set.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cells []spriteCell
+	if err := json.Unmarshal(raw, &cells); err != nil {
+		t.Fatal(err)
+	}
+	want := []spriteCell{
+		{File: files[0], Class: "sprite-1", X: 0, Y: 0, W: 50, H: 50},
+		{File: files[1], Class: "sprite-2", X: 50, Y: 0, W: 50, H: 25},
+		{File: files[2], Class: "sprite-3", X: 0, Y: 50, W: 50, H: 50},
+	}
+	if !slices.Equal(cells, want) {
+		t.Errorf("sprite map = %+v, want %+v", cells, want)
+	}
+	css, err := os.ReadFile(filepath.Join(dir, "out", "set.css"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{`background-image:url("set.jpg")`, ".sprite-3{width:50px;height:50px;background-position:0px -50px} /* c.jpg */"} {
+		if !strings.Contains(string(css), rule) {
+			t.Errorf("sprite CSS lacks %s:\n%s", rule, css)
+		}
+	}
+
+	events = captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "sprite_sheet", Files: []string{filepath.Join(dir, "missing.jpg")}})
+	})
+	if len(events) != 1 || events[0].Status != "failed" {
+		t.Errorf("sprite sheet of a missing file sent %+v", events)
+	}
+}
+
+func TestSkipUploadedReusesEarlierLink(t *testing.T) {
+	useTempStateDir(t)
+	initHTTPClient()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		fmt.Fprintf(w, `{"url":"https://skip.example/%d.jpg"}`, n)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(id string, config map[string]string) []OutputEvent {
+		job := JobRequest{
+			ID: id, Action: "http_upload", Service: "skip.example", Files: []string{fp}, Config: config,
+			HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST", MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+				ResponseParser: ResponseParserSpec{Type: "json", URLPath: "url"}},
+		}
+		return captureEvents(t, func() { handleHttpUpload(context.Background(), job) })
+	}
+	result := func(events []OutputEvent) OutputEvent {
+		for _, ev := range events {
+			if ev.Type == "result" && ev.FilePath == fp {
+				return ev
+			}
+		}
+		t.Fatalf("no result in %+v", events)
+		return OutputEvent{}
+	}
+
+	upload("skip-1", map[string]string{"skip_uploaded": "true"})
+	ev := result(upload("skip-2", map[string]string{"skip_uploaded": "true"}))
+	data, _ := ev.Data.(map[string]interface{})
+	if hits.Load() != 1 || ev.Url != "https://skip.example/1.jpg" || data["cached"] != "true" || data["uploaded_by_job"] != "skip-1" {
+		t.Errorf("second upload: %d requests, result %+v", hits.Load(), ev)
+	}
+	// Reusing the link adds nothing to the history, so a third run still credits skip-1
+	ev = result(upload("skip-2b", map[string]string{"skip_uploaded": "true"}))
+	if data, _ := ev.Data.(map[string]interface{}); data["uploaded_by_job"] != "skip-1" {
+		t.Errorf("third upload credits %v", data["uploaded_by_job"])
+	}
+	if entries, _ := readHistory(); len(entries) != 1 {
+		t.Errorf("history has %d entries after reusing a link: %+v", len(entries), entries)
+	}
+
+	// Another gallery, or not asking to skip, uploads the file again
+	if ev := result(upload("skip-3", map[string]string{"skip_uploaded": "true", "gallery_id": "g2"})); ev.Url != "https://skip.example/2.jpg" {
+		t.Errorf("upload to another gallery reused %s", ev.Url)
+	}
+	if ev := result(upload("skip-4", nil)); ev.Url != "https://skip.example/3.jpg" {
+		t.Errorf("upload without skip_uploaded reused %s", ev.Url)
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	initHTTPClient()
+	var heads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" && strings.HasPrefix(r.URL.Path, "/i/") {
+			heads.Add(1)
+		}
+		switch r.URL.Path {
+		case "/i/alive.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+		case "/i/nohead.jpg":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("GET fallback asked for %q", r.Header.Get("Range"))
+			}
+			w.WriteHeader(http.StatusPartialContent)
+		case "/i/gone.jpg":
+			http.NotFound(w, r)
+		case "/i/taken-down.jpg":
+			http.Redirect(w, r, "/removed.png", http.StatusFound)
+		case "/removed.png":
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	links := []string{srv.URL + "/i/alive.jpg", srv.URL + "/i/nohead.jpg", srv.URL + "/i/gone.jpg", srv.URL + "/i/taken-down.jpg", srv.URL + "/i/broken.jpg", "ftp://example.com/a.jpg"}
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "check_links", URLs: links})
+	})
+	if len(events) != 1 {
+		t.Fatalf("check_links sent %d events", len(events))
+	}
+	data, _ := events[0].Data.(map[string]interface{})
+	results, _ := data["links"].([]interface{})
+	var got []string
+	for _, r := range results {
+		got = append(got, fmt.Sprint(r.(map[string]interface{})["status"]))
+	}
+	if want := []string{"alive", "alive", "dead", "dead", "unknown", "unknown"}; !slices.Equal(got, want) {
+		t.Errorf("link statuses = %v, want %v", got, want)
+	}
+	if events[0].Msg != "2 alive, 2 dead, 2 unknown" {
+		t.Errorf("summary %q", events[0].Msg)
+	}
+	if heads.Load() != 5 {
+		t.Errorf("%d HEAD requests, want one per http link", heads.Load())
+	}
+}
+
+func TestFailureBudgetAbortsBatch(t *testing.T) {
+	initHTTPClient()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "bad api key", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	var files []string
+	for i := range 12 {
+		fp := filepath.Join(dir, fmt.Sprintf("%02d.jpg", i))
+		if err := createTestImage(fp); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fp)
+	}
+	job := JobRequest{
+		ID: "budget-1", Action: "http_upload", Service: "budget.example", Files: files,
+		Config: map[string]string{"max_failure_rate": "20%", "failure_window": "5", "threads": "1"},
+		HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST", MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+			ResponseParser: ResponseParserSpec{Type: "json", URLPath: "url"}},
+	}
+	events := captureEvents(t, func() { handleHttpUpload(context.Background(), job) })
+
+	var aborted bool
+	for _, ev := range events {
+		aborted = aborted || strings.HasPrefix(ev.Msg, "Batch aborted: 2 of the first 2 files failed")
+	}
+	if !aborted {
+		t.Error("no abort event")
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("host got %d uploads, want 2 (more than 20%% of 5 files failed)", n)
+	}
+	if rec := jobs.get("budget-1"); rec == nil || rec.status().State != "failed" {
+		t.Errorf("aborted job not failed: %+v", rec)
+	}
+
+	if err := validateJobRequest(&JobRequest{Action: "upload", Service: "imx.to", Config: map[string]string{"max_failure_rate": "150%"}}); err == nil {
+		t.Error("a failure rate over 100% was accepted")
+	}
+}
+
+func TestHostTermsConflicts(t *testing.T) {
+	useSidecarConfig(t, `{"host_terms": {"pixhost.to": {"max_size": 100}, "files.example": {"types": ["zip"]}}}`)
+	dir := t.TempDir()
+	big, odd := filepath.Join(dir, "big.jpg"), filepath.Join(dir, "doc.pdf")
+	if err := os.WriteFile(big, make([]byte, 200), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(odd, make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := hostTermsConflicts(&JobRequest{Service: "pixhost.to", Files: []string{big, odd}, Config: map[string]string{"anonymous": "true"}})
+	want := []string{
+		"1 file(s) exceed pixhost.to's 100 B limit: big.jpg",
+		"1 file(s) are of a type pixhost.to does not list (jpg, jpeg, png, gif): doc.pdf",
+		"pixhost.to: " + defaultHostTerms["pixhost.to"].AnonymousRetention,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("conflicts = %q, want %q", got, want)
+	}
+	if got := hostTermsConflicts(&JobRequest{Service: "imgur.com", Files: []string{odd}, Config: map[string]string{}}); len(got) != 1 {
+		t.Errorf("imgur conflicts = %q, want only the file type", got)
+	}
+	if got := hostTermsConflicts(&JobRequest{Service: "fastpic.org", Config: map[string]string{"anonymous": "false"}}); len(got) != 0 {
+		t.Errorf("fastpic conflicts = %q", got)
+	}
+	if got := hostTermsConflicts(&JobRequest{Service: "pixhost.to", Config: map[string]string{"pix_content": "1"}}); len(got) != 0 {
+		t.Errorf("adult content on a host allowing it gave %q", got)
+	}
+	defaultHostTerms["test.example"] = hostTerms{Adult: "forbidden"}
+	contentTypeKeys["test.example"] = "postimg_content"
+	t.Cleanup(func() { delete(defaultHostTerms, "test.example"); delete(contentTypeKeys, "test.example") })
+	if got := hostTermsConflicts(&JobRequest{Service: "test.example", Config: map[string]string{"postimg_content": "Adult"}}); len(got) != 1 {
+		t.Errorf("adult content on a host forbidding it gave %q", got)
+	}
+
+	events := captureEvents(t, func() { handleJob(context.Background(), JobRequest{Action: "host_terms", Config: map[string]string{}}) })
+	data := events[0].Data.(map[string]interface{})
+	hosts := data["hosts"].(map[string]interface{})
+	if data["revision"] != HostTermsRevision || hosts["files.example"] == nil || hosts["pixhost.to"].(map[string]interface{})["max_size"] != float64(100) {
+		t.Errorf("host_terms = %v", data)
+	}
+	events = captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "host_terms", Config: map[string]string{"service": "nowhere.example"}})
+	})
+	if events[0].Status != "failed" {
+		t.Errorf("unknown host gave %+v", events[0])
+	}
+}
+
+func TestResumeReconcilesByContent(t *testing.T) {
+	useTempStateDir(t)
+	initHTTPClient()
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hdr, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("no file: %v", err)
+			return
+		}
+		sent = append(sent, hdr.Filename)
+		fmt.Fprintf(w, `{"url":"https://resume.example/%d.jpg"}`, len(sent))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		fp := filepath.Join(dir, name)
+		if err := os.WriteFile(fp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	// One file at a time, so the host numbers the links in file order
+	upload := func(id string, files []string, config map[string]string) []OutputEvent {
+		config = mergeMeta(map[string]string{"threads": "1"}, config)
+		job := JobRequest{
+			ID: id, Action: "http_upload", Service: "resume.example", Files: files, Config: config,
+			HttpSpec: &HttpRequestSpec{URL: srv.URL, Method: "POST", MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+				ResponseParser: ResponseParserSpec{Type: "json", URLPath: "url"}},
+		}
+		return captureEvents(t, func() { handleHttpUpload(context.Background(), job) })
+	}
+
+	a, b, c := write("a.jpg", "one"), write("b.jpg", "two"), write("c.jpg", "three")
+	upload("resume-1", []string{a, b, c}, nil)
+
+	// The folder changed: b renamed, c deleted, d added
+	renamed := filepath.Join(dir, "b-renamed.jpg")
+	if err := os.Rename(b, renamed); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(c)
+	d := write("d.jpg", "four")
+	sent = nil
+	events := upload("resume-2", []string{a, renamed, d}, map[string]string{"resume": "resume-1"})
+
+	if !slices.Equal(sent, []string{"d.jpg"}) {
+		t.Errorf("uploaded %q, want only the new d.jpg", sent)
+	}
+	var rec map[string]interface{}
+	urls := map[string]string{}
+	for _, ev := range events {
+		switch ev.Type {
+		case "resume":
+			rec, _ = ev.Data.(map[string]interface{})
+		case "result":
+			urls[filepath.Base(ev.FilePath)] = ev.Url
+		}
+	}
+	want := map[string]interface{}{
+		"job_id":    "resume-1",
+		"unchanged": []interface{}{a},
+		"renamed":   []interface{}{map[string]interface{}{"from": b, "to": renamed}},
+		"added":     []interface{}{d},
+		"removed":   []interface{}{c},
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("reconciliation = %v, want %v", rec, want)
+	}
+	if urls["a.jpg"] != "https://resume.example/1.jpg" || urls["b-renamed.jpg"] != "https://resume.example/2.jpg" || urls["d.jpg"] != "https://resume.example/1.jpg" {
+		t.Errorf("result links = %v", urls)
+	}
+}
+
+func TestTLSPinsRefuseUnpinnedKeys(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	get := func(serverName string) error {
+		t.Helper()
+		// The test certificate is not for these names; the pin check runs regardless
+		tr := &http.Transport{TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true, VerifyConnection: verifyTLSPins}}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	otherKey := sha256.Sum256([]byte("another key"))
+	other := "sha256/" + base64.StdEncoding.EncodeToString(otherKey[:])
+
+	useSidecarConfig(t, fmt.Sprintf(`{"tls_pins": {"pinned.example": [%q, %q]}}`, other, tlsPin(srv.Certificate())))
+	if err := get("upload.pinned.example"); err != nil {
+		t.Errorf("subdomain with a pinned key refused: %v", err)
+	}
+
+	useSidecarConfig(t, fmt.Sprintf(`{"tls_pins": {"pinned.example": [%q]}}`, other))
+	err := get("upload.pinned.example")
+	if err == nil || !strings.Contains(err.Error(), "tls_pin_mismatch") || !isPermanentError(err, 0) {
+		t.Errorf("mismatched pin gave %v, want a permanent tls_pin_mismatch", err)
+	}
+	if err := get("elsewhere.example"); err != nil {
+		t.Errorf("unpinned host refused: %v", err)
+	}
+
+	// The clients of use_cookies pre-requests and plugin logins check pins too
+	// (trusting the test certificate, which is valid for example.com)
+	useSidecarConfig(t, fmt.Sprintf(`{"tls_pins": {"example.com": [%q]}}`, other))
+	pre := newPreRequestClient()
+	tr := pre.Transport.(*countingTransport).base.(*proxyTransport).base.(*http.Transport)
+	tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	tr.TLSClientConfig.ServerName = "example.com"
+	defer tr.CloseIdleConnections()
+	if resp, err := pre.Get(srv.URL); err == nil {
+		_ = resp.Body.Close()
+		t.Error("pre-request client ignored the pin")
+	} else if !strings.Contains(err.Error(), "tls_pin_mismatch") {
+		t.Errorf("pre-request client gave %v, want tls_pin_mismatch", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.json")
+	_ = os.WriteFile(path, []byte(`{"tls_pins": {"pinned.example": ["md5/abc"]}}`), 0600)
+	if err := loadSidecarConfig(path); err == nil || !strings.Contains(err.Error(), "tls_pins") {
+		t.Errorf("malformed pin loaded: %v", err)
+	}
+}
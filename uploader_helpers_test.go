@@ -163,7 +163,7 @@ func TestHandleJobEmptyAction(t *testing.T) {
 		}
 	}()
 
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 func TestHandleJobEmptyService(t *testing.T) {
@@ -179,7 +179,7 @@ func TestHandleJobEmptyService(t *testing.T) {
 		}
 	}()
 
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 // --- OutputEvent Tests ---
@@ -262,7 +262,7 @@ func TestHandleCreateGalleryEmptyName(t *testing.T) {
 		}
 	}()
 
-	handleCreateGallery(job)
+	handleCreateGallery(context.Background(), job)
 }
 
 func TestHandleFinalizeGalleryEmptyConfig(t *testing.T) {
@@ -278,7 +278,7 @@ func TestHandleFinalizeGalleryEmptyConfig(t *testing.T) {
 		}
 	}()
 
-	handleFinalizeGallery(job)
+	handleFinalizeGallery(context.Background(), job)
 }
 
 // --- Additional Action Tests ---
@@ -299,7 +299,7 @@ func TestHandleLoginVerifyVipr(t *testing.T) {
 		}
 	}()
 
-	handleLoginVerify(job)
+	handleLoginVerify(context.Background(), job)
 }
 
 func TestHandleLoginVerifyImageBam(t *testing.T) {
@@ -318,7 +318,7 @@ func TestHandleLoginVerifyImageBam(t *testing.T) {
 		}
 	}()
 
-	handleLoginVerify(job)
+	handleLoginVerify(context.Background(), job)
 }
 
 func TestHandleLoginVerifyTurbo(t *testing.T) {
@@ -337,7 +337,7 @@ func TestHandleLoginVerifyTurbo(t *testing.T) {
 		}
 	}()
 
-	handleLoginVerify(job)
+	handleLoginVerify(context.Background(), job)
 }
 
 // --- Benchmark Tests ---
@@ -258,7 +258,7 @@ func TestProcessFileWithTimeout(t *testing.T) {
 	}
 
 	start := time.Now()
-	processFile(testFile, job)
+	processFile(context.Background(), testFile, job)
 	duration := time.Since(start)
 
 	// Should complete quickly for unsupported service
@@ -0,0 +1,1275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTempStateDir points stateDir at a temporary directory for the duration of a test
+func useTempStateDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	old := stateDir
+	stateDir = dir
+	t.Cleanup(func() { stateDir = old })
+	return dir
+}
+
+// --- Job Registry Tests ---
+
+func TestJobRegistryTracksFileEvents(t *testing.T) {
+	job := &JobRequest{
+		Action:  "upload",
+		Service: "imx.to",
+		Files:   []string{"/tmp/a.jpg", "/tmp/b.jpg", "/tmp/a.jpg"},
+	}
+	rec, _ := jobs.register(job)
+	job.record = rec
+
+	if rec.State != "queued" {
+		t.Errorf("new job state = %q, want queued", rec.State)
+	}
+	if len(rec.Files) != 2 {
+		t.Fatalf("tracked %d files, want 2 (duplicates collapsed)", len(rec.Files))
+	}
+
+	sendJobEvent(job, OutputEvent{Type: "status", FilePath: "/tmp/a.jpg", Status: "Uploading"})
+	sendJobEvent(job, OutputEvent{Type: "progress", FilePath: "/tmp/a.jpg", Data: ProgressEvent{BytesTransferred: 10, TotalBytes: 20}})
+	sendJobEvent(job, OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://imx.to/i/a", Thumb: "https://imx.to/t/a"})
+	sendJobEvent(job, OutputEvent{Type: "status", FilePath: "/tmp/a.jpg", Status: "Done"})
+	sendJobEvent(job, OutputEvent{Type: "error", FilePath: "/tmp/b.jpg", Msg: "boom"})
+	sendJobEvent(job, OutputEvent{Type: "status", FilePath: "/tmp/unknown.jpg", Status: "Done"})
+
+	a := rec.Files[0]
+	if a.Status != "Done" || a.Url != "https://imx.to/i/a" || a.BytesTransferred != 10 || a.TotalBytes != 20 {
+		t.Errorf("unexpected record for a.jpg: %+v", a)
+	}
+	if b := rec.Files[1]; b.Error != "boom" || b.Status != "Queued" {
+		t.Errorf("unexpected record for b.jpg: %+v", b)
+	}
+	if got := jobs.get(rec.ID); got != rec {
+		t.Error("jobs.get should return the registered record")
+	}
+}
+
+func TestJobSnapshotPersistence(t *testing.T) {
+	dir := useTempStateDir(t)
+
+	job := &JobRequest{Action: "upload", Service: "pixhost.to", Files: []string{"/tmp/x.jpg"}}
+	rec, _ := jobs.register(job)
+	rec.setState("running")
+	rec.apply(OutputEvent{Type: "result", FilePath: "/tmp/x.jpg", Url: "https://pixhost.to/show/1/x.jpg"})
+
+	jobs.checkpoint()
+	if _, err := os.Stat(filepath.Join(dir, "jobs", rec.ID+".json")); err != nil {
+		t.Fatalf("checkpoint did not write snapshot: %v", err)
+	}
+
+	// A running job loaded from disk belongs to a previous process
+	loaded, err := loadJobSnapshot(rec.ID)
+	if err != nil {
+		t.Fatalf("loadJobSnapshot failed: %v", err)
+	}
+	if loaded.State != "interrupted" {
+		t.Errorf("loaded state = %q, want interrupted", loaded.State)
+	}
+	if len(loaded.Files) != 1 || loaded.Files[0].Url != "https://pixhost.to/show/1/x.jpg" {
+		t.Errorf("loaded files = %+v", loaded.Files)
+	}
+
+	jobs.finish(rec)
+	loaded, err = loadJobSnapshot(rec.ID)
+	if err != nil {
+		t.Fatalf("loadJobSnapshot after finish failed: %v", err)
+	}
+	if loaded.State != "completed" {
+		t.Errorf("state after finish = %q, want completed", loaded.State)
+	}
+}
+
+func TestRejectedJobIsRetiredAsFailed(t *testing.T) {
+	dir := useTempStateDir(t)
+
+	job := JobRequest{ID: "rejected-1", Action: "upload", Service: "imx.to", Files: []string{"/nonexistent/a.jpg"}}
+	job.record, _ = jobs.register(&job)
+	captureEvents(t, func() { handleJob(context.Background(), job) })
+
+	if job.record.State != "failed" {
+		t.Errorf("state = %q, want failed", job.record.State)
+	}
+	loaded, err := loadJobSnapshot("rejected-1")
+	if err != nil || loaded.State != "failed" {
+		t.Errorf("snapshot = %+v, %v", loaded, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "jobs"))
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Errorf("temp file left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestConcurrentSnapshotWrites(t *testing.T) {
+	useTempStateDir(t)
+	rec, _ := jobs.register(&JobRequest{Action: "upload", Service: "imx.to"})
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			persistJobSnapshot(rec)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	if _, err := loadJobSnapshot(rec.ID); err != nil {
+		t.Errorf("snapshot corrupted by concurrent writes: %v", err)
+	}
+}
+
+func TestCheckpointRacingFinishKeepsFinalState(t *testing.T) {
+	useTempStateDir(t)
+	for i := 0; i < 300; i++ {
+		rec, _ := jobs.register(&JobRequest{Action: "upload", Service: "imx.to"})
+		rec.setState("running")
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				persistJobSnapshot(rec)
+			}()
+		}
+		close(start)
+		jobs.finish(rec)
+		wg.Wait()
+		loaded, err := loadJobSnapshot(rec.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.State != "completed" {
+			t.Fatalf("snapshot state = %q after finish, want completed", loaded.State)
+		}
+	}
+}
+
+func TestLoadJobSnapshotRejectsBadIDs(t *testing.T) {
+	useTempStateDir(t)
+
+	for _, id := range []string{"", "../etc/passwd", "a/b", "with space"} {
+		if _, err := loadJobSnapshot(id); err == nil {
+			t.Errorf("loadJobSnapshot(%q) should fail", id)
+		}
+	}
+}
+
+func TestPersistenceDisabledWithoutStateDir(t *testing.T) {
+	old := stateDir
+	stateDir = ""
+	defer func() { stateDir = old }()
+
+	rec, _ := jobs.register(&JobRequest{Action: "upload", Files: []string{"/tmp/y.jpg"}})
+	persistJobSnapshot(rec) // must be a no-op
+
+	if _, err := loadJobSnapshot(rec.ID); err == nil {
+		t.Error("loadJobSnapshot should fail when persistence is disabled")
+	}
+}
+
+// --- Job ID Tests ---
+
+func TestJobIDEchoedOnEvents(t *testing.T) {
+	initHTTPClient()
+
+	job := JobRequest{
+		ID:      "batch-42",
+		Action:  "create_gallery",
+		Service: "unsupported.service",
+		Config:  map[string]string{"gallery_name": "x"},
+	}
+	events := captureEvents(t, func() { handleCreateGallery(context.Background(), job) })
+
+	if len(events) == 0 {
+		t.Fatal("expected at least one event")
+	}
+	for _, ev := range events {
+		if ev.JobID != "batch-42" {
+			t.Errorf("event %+v missing job_id", ev)
+		}
+	}
+}
+
+func TestRegisterUsesClientJobID(t *testing.T) {
+	job := &JobRequest{ID: "client-id-1", Action: "upload", Files: []string{"/tmp/a.jpg"}}
+	rec, _ := jobs.register(job)
+	if rec.ID != "client-id-1" {
+		t.Errorf("record ID = %q, want client-id-1", rec.ID)
+	}
+
+	generated := &JobRequest{Action: "upload", Files: []string{"/tmp/a.jpg"}}
+	rec, _ = jobs.register(generated)
+	if generated.ID == "" || generated.ID != rec.ID {
+		t.Errorf("generated job ID %q should be written back (record %q)", generated.ID, rec.ID)
+	}
+}
+
+func TestRegisterRejectsActiveDuplicate(t *testing.T) {
+	useTempStateDir(t)
+	r := &jobRegistry{jobs: make(map[string]*jobRecord)}
+	first, err := r.register(&JobRequest{ID: "dup-1", Action: "upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.register(&JobRequest{ID: "dup-1", Action: "upload"}); err == nil {
+		t.Error("a queued job ID must not be registered twice")
+	}
+	if r.get("dup-1") != first {
+		t.Error("the live record was replaced")
+	}
+
+	r.finish(first)
+	second, err := r.register(&JobRequest{ID: "dup-1", Action: "upload"})
+	if err != nil || r.get("dup-1") != second {
+		t.Fatalf("a finished job ID should be reusable: %v", err)
+	}
+	r.finish(second)
+	if len(r.finished) != 1 {
+		t.Errorf("finished = %v, want the ID once", r.finished)
+	}
+}
+
+func TestValidateJobRequestJobID(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(tmpFile); err != nil {
+		t.Fatalf("Failed to create test image: %v", err)
+	}
+
+	job := JobRequest{ID: "../../etc", Action: "upload", Service: "imx.to", Files: []string{tmpFile}}
+	if err := validateJobRequest(&job); err == nil {
+		t.Error("validateJobRequest should reject unsafe job IDs")
+	}
+	job.ID = "ok_id-1"
+	if err := validateJobRequest(&job); err != nil {
+		t.Errorf("validateJobRequest rejected valid job ID: %v", err)
+	}
+}
+
+func TestShutdownCancelsQueuedJobsAndReportsUnfinishedWork(t *testing.T) {
+	useTempStateDir(t)
+	queued, _ := jobs.register(&JobRequest{ID: "shutdown-queued", Action: "upload", Service: "imx.to", Files: []string{"/tmp/q.jpg"}})
+	running, _ := jobs.register(&JobRequest{ID: "shutdown-running", Action: "upload", Service: "imx.to", Files: []string{"/tmp/a.jpg", "/tmp/b.jpg"}})
+	done, _ := jobs.register(&JobRequest{ID: "shutdown-done", Action: "upload", Service: "imx.to", Files: []string{"/tmp/c.jpg"}})
+	running.setState("running")
+	running.apply(OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://imx.to/i/a"})
+	jobs.finish(done)
+
+	jobs.cancelQueued(errSidecarShutdown)
+	if !queued.wasCancelled() || running.wasCancelled() {
+		t.Errorf("cancelled: queued %v, running %v; want only the queued job", queued.wasCancelled(), running.wasCancelled())
+	}
+	jobs.finish(queued)
+
+	ev := shutdownEvent("signal: terminated")
+	if ev.Type != "shutdown" || ev.Status != "incomplete" {
+		t.Errorf("event = %+v", ev)
+	}
+	got := map[string]unfinishedJob{}
+	for _, j := range ev.Data.(map[string]interface{})["incomplete"].([]unfinishedJob) {
+		got[j.ID] = j
+	}
+	if j := got["shutdown-queued"]; j.State != "cancelled" || !slices.Equal(j.Unfinished, []string{"/tmp/q.jpg"}) {
+		t.Errorf("queued job reported as %+v", j)
+	}
+	if j := got["shutdown-running"]; j.State != "running" || !slices.Equal(j.Unfinished, []string{"/tmp/b.jpg"}) {
+		t.Errorf("running job reported as %+v", j)
+	}
+	if _, ok := got["shutdown-done"]; ok {
+		t.Error("a completed job was reported as unfinished")
+	}
+	jobs.finish(running)
+}
+
+// --- job_status Action Tests ---
+
+func TestHandleJobStatusKnownJob(t *testing.T) {
+	rec, _ := jobs.register(&JobRequest{ID: "status-test-1", Action: "upload", Service: "imx.to", Files: []string{"/tmp/a.jpg", "/tmp/b.jpg"}})
+	rec.setState("running")
+	rec.apply(OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://imx.to/i/a"})
+	rec.apply(OutputEvent{Type: "status", FilePath: "/tmp/b.jpg", Status: "Failed"})
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{ID: "query-1", Action: "job_status", Config: map[string]string{"job_id": "status-test-1"}})
+	})
+	if len(events) != 1 || events[0].Status != "success" || events[0].JobID != "query-1" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	b, _ := json.Marshal(events[0].Data)
+	var st jobStatus
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatalf("failed to decode job status: %v", err)
+	}
+	if st.State != "running" || st.Total != 2 || st.Completed != 1 || st.Failed != 1 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
+
+func TestHandleJobStatusUnknownJob(t *testing.T) {
+	useTempStateDir(t)
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "job_status", Config: map[string]string{"job_id": "does-not-exist"}})
+	})
+	if len(events) != 1 || events[0].Status != "failed" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestHandleJobStatusFromSnapshot(t *testing.T) {
+	useTempStateDir(t)
+
+	rec := &jobRecord{ID: "persisted-1", Action: "upload", State: "running", Files: []*fileProgress{{Path: "/tmp/a.jpg", Status: "Done", Url: "https://imx.to/i/a"}}}
+	persistJobSnapshot(rec)
+
+	got, err := jobs.lookup("persisted-1")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if st := got.status(); st.State != "interrupted" || st.Completed != 1 {
+		t.Errorf("unexpected status from snapshot: %+v", st)
+	}
+}
+
+// --- cancel Action Tests ---
+
+func TestCancelStopsRunningUpload(t *testing.T) {
+	initHTTPClient()
+	arrived := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		arrived <- struct{}{}
+		<-r.Context().Done() // hang until the client gives up
+	}))
+	defer server.Close()
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+
+	job := JobRequest{ID: "cancel-running-1", Action: "http_upload", Service: "plugin", Files: []string{fp},
+		RetryConfig: &RetryConfig{MaxRetries: 0},
+		HttpSpec: &HttpRequestSpec{URL: server.URL, Method: "POST",
+			MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+			ResponseParser:  ResponseParserSpec{Type: "json", URLPath: "url"}}}
+	job.record, _ = jobs.register(&job)
+
+	events := captureEvents(t, func() {
+		done := make(chan struct{})
+		go func() { defer close(done); handleJob(context.Background(), job) }()
+		<-arrived
+		handleJob(context.Background(), JobRequest{Action: "cancel", Config: map[string]string{"job_id": job.ID}})
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the job kept running after it was cancelled")
+		}
+	})
+
+	var acked, cancelled bool
+	for _, ev := range events {
+		acked = acked || (ev.Type == "data" && ev.Status == "success")
+		cancelled = cancelled || (ev.Type == "error" && ev.FilePath == fp && strings.Contains(ev.Msg, "cancel"))
+	}
+	if !acked || !cancelled {
+		t.Errorf("expected the cancel to be acknowledged and the file to fail as cancelled, got %+v", events)
+	}
+	if job.record.State != "cancelled" {
+		t.Errorf("state = %q, want cancelled", job.record.State)
+	}
+}
+
+func TestCancelQueuedAndFinishedJobs(t *testing.T) {
+	job := JobRequest{ID: "cancel-queued-1", Action: "upload", Service: "imx.to", Files: []string{"/tmp/a.jpg"}}
+	job.record, _ = jobs.register(&job)
+	cancel := func(id string) OutputEvent {
+		events := captureEvents(t, func() {
+			handleJob(context.Background(), JobRequest{Action: "cancel", Config: map[string]string{"job_id": id}})
+		})
+		if len(events) != 1 {
+			t.Fatalf("unexpected events: %+v", events)
+		}
+		return events[0]
+	}
+
+	if ev := cancel(job.ID); ev.Status != "success" {
+		t.Fatalf("cancelling a queued job failed: %+v", ev)
+	}
+	// The worker that picks it up retires it without uploading anything
+	events := captureEvents(t, func() { handleJob(context.Background(), job) })
+	if len(events) != 1 || events[0].Type != "error" || job.record.State != "cancelled" {
+		t.Errorf("state = %q, events = %+v", job.record.State, events)
+	}
+
+	if ev := cancel(job.ID); ev.Status != "failed" || !strings.Contains(ev.Msg, "already finished") {
+		t.Errorf("cancelling a finished job: %+v", ev)
+	}
+	if ev := cancel("no-such-job"); ev.Status != "failed" {
+		t.Errorf("cancelling an unknown job: %+v", ev)
+	}
+}
+
+// --- Publish Tests ---
+
+func TestWaitForMirrorsQuorum(t *testing.T) {
+	useTempStateDir(t)
+
+	done, _ := jobs.register(&JobRequest{ID: "mirror-done", Action: "upload", Service: "imx.to", Files: []string{"/tmp/a.jpg"}})
+	done.apply(OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://imx.to/i/a", Thumb: "https://image.imx.to/u/t/a.jpg"})
+	jobs.finish(done)
+	running, _ := jobs.register(&JobRequest{ID: "mirror-running", Action: "upload", Service: "pixhost.to", Files: []string{"/tmp/a.jpg"}})
+	running.setState("running")
+
+	ids := []string{"mirror-done", "mirror-running"}
+	sts, err := waitForMirrors(context.Background(), ids, 1, time.Millisecond)
+	if err != nil {
+		t.Fatalf("quorum of 1 should be met: %v", err)
+	}
+	if len(sts) != 2 {
+		t.Fatalf("got %d statuses, want 2", len(sts))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := waitForMirrors(ctx, ids, 2, time.Millisecond); err == nil {
+		t.Error("waiting for a running mirror should time out")
+	}
+
+	// Once the second mirror fails, a quorum of 2 can never be met
+	running.apply(OutputEvent{Type: "status", FilePath: "/tmp/a.jpg", Status: "Failed"})
+	jobs.finish(running)
+	if _, err := waitForMirrors(context.Background(), ids, 2, time.Millisecond); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("expected unreachable quorum error, got %v", err)
+	}
+}
+
+func TestBuildMirrorMessage(t *testing.T) {
+	sts := []jobStatus{
+		{Service: "imx.to", State: "completed", Total: 1, Completed: 1, Files: []fileProgress{{Url: "https://imx.to/i/a", Thumb: "https://image.imx.to/u/t/a.jpg"}}},
+		{Service: "pixhost.to", State: "running", Total: 1},
+	}
+	got := buildMirrorMessage("Set 1\n{mirrors}\nEnjoy", sts, "bbcode")
+	want := "Set 1\n[b]imx.to[/b]\n[url=https://imx.to/i/a][img]https://image.imx.to/u/t/a.jpg[/img][/url]\nEnjoy"
+	if got != want {
+		t.Errorf("buildMirrorMessage =\n%q\nwant\n%q", got, want)
+	}
+	if got := buildMirrorMessage("Intro", sts, "bbcode"); !strings.HasPrefix(got, "Intro\n\n[b]imx.to[/b]") {
+		t.Errorf("mirrors should be appended without a placeholder, got %q", got)
+	}
+	if got := buildMirrorMessage("", sts, "markdown"); got != "**imx.to**\n[![](https://image.imx.to/u/t/a.jpg)](https://imx.to/i/a)" {
+		t.Errorf("markdown mirrors = %q", got)
+	}
+}
+
+func TestHandlePublishRequiresMirrors(t *testing.T) {
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "publish", Config: map[string]string{"thread_id": "1"}})
+	})
+	if len(events) != 1 || events[0].Status != "failed" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestHandlePublishRejectsUnknownMirrors(t *testing.T) {
+	useTempStateDir(t)
+	_, _ = jobs.register(&JobRequest{ID: "mirror-known", Action: "upload", Service: "imx.to"})
+
+	start := time.Now()
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "publish", Config: map[string]string{"thread_id": "1", "mirror_jobs": "mirror-known,mirror-typo"}})
+	})
+	if len(events) != 1 || events[0].Status != "failed" || !strings.Contains(events[0].Msg, "mirror-typo") {
+		t.Errorf("unexpected events: %+v", events)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("unknown mirrors should fail without waiting")
+	}
+}
+
+func TestMirrorCountsMatchSnapshot(t *testing.T) {
+	sts := []jobStatus{
+		{ID: "a", State: "completed", Total: 1, Completed: 1},
+		{ID: "b", State: "running", Total: 1},
+	}
+	if done, pending := mirrorCounts(sts); done != 1 || pending != 1 {
+		t.Errorf("done, pending = %d, %d; want 1, 1", done, pending)
+	}
+}
+
+func TestWaitForNextMirror(t *testing.T) {
+	useTempStateDir(t)
+
+	first, _ := jobs.register(&JobRequest{ID: "late-1", Action: "upload", Service: "imx.to", Files: []string{"/tmp/a.jpg"}})
+	first.apply(OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://imx.to/i/a"})
+	jobs.finish(first)
+	late, _ := jobs.register(&JobRequest{ID: "late-2", Action: "upload", Service: "pixhost.to", Files: []string{"/tmp/a.jpg"}})
+	late.setState("running")
+
+	ids := []string{"late-1", "late-2"}
+	posted := map[string]bool{"late-1": true}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		late.apply(OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://pixhost.to/show/1/a.jpg"})
+		jobs.finish(late)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, added, pending := waitForNextMirror(ctx, ids, posted, time.Millisecond)
+	if len(added) != 1 || added[0] != "late-2" || pending != 0 {
+		t.Errorf("added = %v, pending = %d; want [late-2], 0", added, pending)
+	}
+}
+
+// --- Bandwidth Usage Tests ---
+
+// useFreshUsage swaps in an empty usage ledger for the duration of a test
+func useFreshUsage(t *testing.T) *usageLedger {
+	t.Helper()
+	old := usage
+	usage = &usageLedger{}
+	t.Cleanup(func() { usage = old })
+	return usage
+}
+
+func TestUsageLedgerAddAndReport(t *testing.T) {
+	u := useFreshUsage(t)
+	oct := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	u.add("imx.to", 100, oct)
+	u.add("imx.to", 50, oct.Add(24*time.Hour))
+	u.add("pixhost.to", 7, oct)
+
+	daily, monthly := u.report("")
+	if daily["2026-10-16"]["imx.to"] != 100 || daily["2026-10-17"]["imx.to"] != 50 || daily["2026-10-16"]["pixhost.to"] != 7 {
+		t.Errorf("unexpected daily counters: %v", daily)
+	}
+	if monthly["2026-10"]["imx.to"] != 150 {
+		t.Errorf("monthly imx.to = %d, want 150", monthly["2026-10"]["imx.to"])
+	}
+
+	_, monthly = u.report("pixhost.to")
+	if len(monthly["2026-10"]) != 1 || monthly["2026-10"]["pixhost.to"] != 7 {
+		t.Errorf("service filter not applied: %v", monthly)
+	}
+}
+
+func TestUsageLedgerPrune(t *testing.T) {
+	u := useFreshUsage(t)
+	now := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	u.add("imx.to", 1, now.Add(-UsageDailyRetention-24*time.Hour))
+	u.add("imx.to", 1, now)
+	u.prune(now)
+
+	daily, monthly := u.report("")
+	if len(daily) != 1 || daily["2026-10-16"] == nil {
+		t.Errorf("expected only today's counters to survive, got %v", daily)
+	}
+	if len(monthly) != 2 {
+		t.Errorf("monthly counters should not be pruned, got %v", monthly)
+	}
+}
+
+func TestUsageLedgerPersistence(t *testing.T) {
+	useTempStateDir(t)
+	u := useFreshUsage(t)
+	u.add("imx.to", 42, time.Now())
+	u.flush()
+
+	reloaded := &usageLedger{}
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	_, monthly := reloaded.report("imx.to")
+	if monthly[time.Now().Format("2006-01")]["imx.to"] != 42 {
+		t.Errorf("counters not persisted: %v", monthly)
+	}
+}
+
+func TestBatchETAFromThroughputHistory(t *testing.T) {
+	useTempStateDir(t)
+	old := throughput
+	throughput = &throughputLedger{}
+	t.Cleanup(func() { throughput = old })
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		fp := filepath.Join(dir, name)
+		if err := os.WriteFile(fp, make([]byte, 4000), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fp)
+	}
+	eta := func(service string) []OutputEvent {
+		t.Helper()
+		return captureEvents(t, func() {
+			sendBatchETA(&JobRequest{ID: "eta-1", Service: service, Files: files, Config: map[string]string{"threads": "2"}})
+		})
+	}
+
+	if events := eta("pixhost.to"); len(events) != 0 {
+		t.Errorf("ETA without any history: %+v", events)
+	}
+
+	// One second per file plus two per kilobyte: 9s for each 4000-byte file
+	for i := 0; i < MinThroughputSamples; i++ {
+		size := int64(1000 * (i%3 + 1))
+		throughput.add("pixhost.to", size, time.Duration(1000+2*size)*time.Millisecond)
+	}
+	for _, tc := range []struct{ service, basis string }{{"pixhost.to", "host"}, {"imx.to", "all_hosts"}} {
+		events := eta(tc.service)
+		if len(events) != 1 || events[0].Type != "eta" {
+			t.Fatalf("%s: events %+v", tc.service, events)
+		}
+		data := events[0].Data.(map[string]interface{})
+		if data["eta_seconds"] != 9.0 || data["basis"] != tc.basis || data["parallel"] != 2.0 || data["eta"] != "less than a minute" {
+			t.Errorf("%s: eta data %v", tc.service, data)
+		}
+	}
+
+	throughput.flush()
+	reloaded := &throughputLedger{}
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if fit, basis, ok := reloaded.fit("pixhost.to"); !ok || basis != "host" || fit.Samples != MinThroughputSamples {
+		t.Errorf("history not persisted: %+v %q %v", fit, basis, ok)
+	}
+
+	for d, want := range map[time.Duration]string{
+		59 * time.Second:              "less than a minute",
+		61 * time.Second:              "about 1 minute",
+		25 * time.Minute:              "about 25 minutes",
+		3 * time.Hour:                 "about 3 hours",
+		2*time.Hour + 10*time.Minute:  "about 2 hours 10 minutes",
+		time.Hour + 1*time.Minute + 1: "about 1 hour 1 minute",
+	} {
+		if got := humanizeETA(d); got != want {
+			t.Errorf("humanizeETA(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestUsageTransportCountsRequestBodies(t *testing.T) {
+	u := useFreshUsage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+	c := &http.Client{Transport: &countingTransport{base: http.DefaultTransport}}
+
+	send := func(ctx context.Context) {
+		req, _ := http.NewRequestWithContext(ctx, "POST", server.URL, strings.NewReader("0123456789"))
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	send(withUsageService(context.Background(), "imx.to"))
+	send(context.Background()) // untagged requests are not billed to any service
+
+	_, monthly := u.report("")
+	month := monthly[time.Now().Format("2006-01")]
+	if len(month) != 1 || month["imx.to"] != 10 {
+		t.Errorf("unexpected usage: %v", monthly)
+	}
+}
+
+func TestHttpUploadWithCookiePreRequestIsCounted(t *testing.T) {
+	u := useFreshUsage(t)
+	old := client
+	client = &http.Client{Transport: &countingTransport{base: http.DefaultTransport}}
+	t.Cleanup(func() { client = old })
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			_, _ = io.Copy(io.Discard, r.Body)
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1"})
+			_, _ = io.WriteString(w, `{}`)
+			return
+		}
+		if _, err := r.Cookie("sid"); err != nil {
+			t.Error("upload did not carry the pre-request's cookie")
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, `{"data":{"url":"https://example.com/a.jpg"}}`)
+	}))
+	defer server.Close()
+
+	fp := filepath.Join(t.TempDir(), "a.jpg")
+	if err := createTestImage(fp); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(fp)
+	job := &JobRequest{Service: "plugin", HttpSpec: &HttpRequestSpec{
+		URL:             server.URL + "/upload",
+		Method:          "POST",
+		MultipartFields: map[string]MultipartField{"file": {Type: "file"}},
+		ResponseParser:  ResponseParserSpec{Type: "json", URLPath: "data.url"},
+		PreRequest: &PreRequestSpec{
+			URL: server.URL + "/login", Method: "POST", UseCookies: true, ResponseType: "json",
+			FormFields: map[string]string{"user": "u"},
+		},
+	}}
+	if _, _, err := executeHttpUpload(withUsageService(context.Background(), "plugin"), fp, job); err != nil {
+		t.Fatal(err)
+	}
+
+	_, monthly := u.report("plugin")
+	if got := monthly[time.Now().Format("2006-01")]["plugin"]; got <= info.Size() {
+		t.Errorf("usage = %d, want the login form plus more than the %d-byte file", got, info.Size())
+	}
+}
+
+func TestHandleUsageReport(t *testing.T) {
+	u := useFreshUsage(t)
+	u.add("imx.to", 5, time.Now())
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "usage_report", Config: map[string]string{"service": "imx.to"}})
+	})
+	if len(events) != 1 || events[0].Type != "data" || events[0].Status != "success" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	data, _ := events[0].Data.(map[string]interface{})
+	if data["month"] != time.Now().Format("2006-01") || data["monthly"] == nil {
+		t.Errorf("unexpected report: %+v", data)
+	}
+}
+
+// --- Batch Log Export Tests ---
+
+func TestJobReportAttemptsAndDurations(t *testing.T) {
+	job := &JobRequest{Action: "upload", Service: "imx.to", Files: []string{"/tmp/a.jpg", "/tmp/b.jpg"}}
+	job.record, _ = jobs.register(job)
+
+	captureEvents(t, func() {
+		sendJobEvent(job, OutputEvent{Type: "status", FilePath: "/tmp/a.jpg", Status: "Uploading"})
+		var attempts uploadAttempts
+		attempts.begin(job, "/tmp/a.jpg")
+		attempts.end(fmt.Errorf("HTTP 503"))
+		attempts.begin(job, "/tmp/a.jpg")
+		sendJobEvent(job, OutputEvent{Type: "progress", FilePath: "/tmp/a.jpg", Data: ProgressEvent{BytesTransferred: 1}})
+		sendJobEvent(job, OutputEvent{Type: "progress", FilePath: "/tmp/a.jpg", Data: ProgressEvent{BytesTransferred: 2}})
+		sendJobEvent(job, OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://imx.to/i/a"})
+		sendJobEvent(job, OutputEvent{Type: "log", Msg: "batch note"})
+	})
+	jobs.finish(job.record)
+
+	r := job.record.report()
+	if r.Files[0].Attempts != 2 || r.Files[0].Finished.IsZero() || r.Files[0].Url != "https://imx.to/i/a" {
+		t.Errorf("unexpected file report: %+v", r.Files[0])
+	}
+	if r.Files[1].Attempts != 0 || !r.Files[1].Started.IsZero() {
+		t.Errorf("untouched file should have no attempts: %+v", r.Files[1])
+	}
+	// status, retry, one collapsed progress, result, log
+	if len(r.Events) != 5 {
+		t.Fatalf("expected 5 timeline events, got %d: %+v", len(r.Events), r.Events)
+	}
+	if r.Events[1].Type != "retry" || r.Events[1].Msg != "HTTP 503" {
+		t.Errorf("retry event = %+v", r.Events[1])
+	}
+	if p, _ := r.Events[2].Data.(ProgressEvent); p.BytesTransferred != 2 {
+		t.Errorf("progress events should collapse to the latest, got %+v", r.Events[2])
+	}
+}
+
+func TestHandleExportLog(t *testing.T) {
+	job := &JobRequest{ID: "export-1", Action: "upload", Service: "imx.to", Files: []string{"/tmp/a.jpg"}}
+	job.record, _ = jobs.register(job)
+	captureEvents(t, func() {
+		sendJobEvent(job, OutputEvent{Type: "error", FilePath: "/tmp/a.jpg", Msg: "<boom>"})
+	})
+	jobs.finish(job.record)
+
+	path := filepath.Join(t.TempDir(), "report.html")
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "export_log", Config: map[string]string{"job_id": "export-1", "format": "html", "path": path}})
+	})
+	if len(events) != 1 || events[0].Status != "success" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "&lt;boom&gt;") || !strings.Contains(string(b), "export-1") {
+		t.Errorf("HTML report missing escaped error or job ID:\n%s", b)
+	}
+
+	events = captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "export_log", Config: map[string]string{"job_id": "export-1"}})
+	})
+	var r jobReport
+	if s, _ := events[0].Data.(string); json.Unmarshal([]byte(s), &r) != nil || r.ID != "export-1" || len(r.Events) != 1 {
+		t.Errorf("unexpected JSON report: %+v", events[0])
+	}
+}
+
+// --- Session Manager Tests ---
+
+// useFreshSessions swaps in an empty session manager for the duration of a test
+func useFreshSessions(t *testing.T) *SessionManager {
+	t.Helper()
+	old := sessions
+	sessions = &SessionManager{sessions: map[sessionKey]*session{}, current: map[string]string{}}
+	t.Cleanup(func() { sessions = old })
+	return sessions
+}
+
+func TestSessionStateIsPerAccount(t *testing.T) {
+	initHTTPClient()
+	useFreshSessions(t)
+	alice := withSession(context.Background(), "vipr.im", map[string]string{"vipr_user": "alice"})
+	bob := withSession(context.Background(), "vipr.im", map[string]string{"vipr_user": "bob"})
+
+	sessionState[xfsState](alice, "vipr.im").sessId = "alice-sess"
+	if got := sessionState[xfsState](bob, "vipr.im").sessId; got != "" {
+		t.Errorf("bob's session sees %q", got)
+	}
+	if got := sessionState[xfsState](alice, "vipr.im").sessId; got != "alice-sess" {
+		t.Errorf("alice's session = %q", got)
+	}
+	if sessionJar(alice) == nil || sessionJar(alice) == sessionJar(bob) {
+		t.Error("named accounts should each get their own cookie jar")
+	}
+	if httpClientFor(alice).Jar != sessionJar(alice) {
+		t.Error("httpClientFor should use the session's jar")
+	}
+}
+
+func TestAnonymousSessionIsSeparate(t *testing.T) {
+	useFreshSessions(t)
+	creds := map[string]string{"imgbox_user": "alice"}
+	account := withSession(context.Background(), "imgbox.com", creds)
+	sessionState[imgboxState](account, "imgbox.com").csrf = "alice-csrf"
+
+	job := &JobRequest{Service: "imgbox.com", Config: map[string]string{"anonymous": "true"}, Creds: creds}
+	anon := withJobSession(context.Background(), job)
+	if got := sessionState[imgboxState](anon, "imgbox.com").csrf; got != "" {
+		t.Errorf("anonymous session sees %q", got)
+	}
+	if sessionJar(anon) != nil {
+		t.Error("anonymous sessions must not have a cookie jar")
+	}
+}
+
+func TestSessionWithoutAccountUsesCurrent(t *testing.T) {
+	useFreshSessions(t)
+	guest := withSession(context.Background(), "vipergirls.to", nil)
+	if sessionJar(guest) != nil {
+		t.Error("guest session should use the shared jar")
+	}
+
+	login := withSession(context.Background(), "vipergirls.to", map[string]string{"vg_user": "carol"})
+	sessionState[vbulletinState](login, "vipergirls.to").securityToken = "tok"
+
+	// viper_post carries no creds, so it continues the session the login opened
+	post := withSession(context.Background(), "vipergirls.to", map[string]string{})
+	if got := sessionState[vbulletinState](post, "vipergirls.to").securityToken; got != "tok" {
+		t.Errorf("securityToken = %q, want the logged-in account's", got)
+	}
+	if sessionState[vbulletinState](context.Background(), "vipergirls.to").securityToken != "tok" {
+		t.Error("contexts outside a job should resolve to the current account")
+	}
+}
+
+func TestCheveretoSessionUsesSitePrefix(t *testing.T) {
+	useFreshSessions(t)
+	site := cheveretoSites["pixl.li"]
+	a := withSession(context.Background(), site.service, map[string]string{"pixl_user": "dave"})
+	b := withSession(context.Background(), site.service, map[string]string{"pixl_user": "erin"})
+	cheveretoStateFor(a, site).username = "dave"
+	if cheveretoStateFor(b, site).username != "" {
+		t.Error("chevereto sessions should be keyed by <prefix>_user")
+	}
+}
+
+func TestRedactEventScrubsMessagesAndTypedData(t *testing.T) {
+	type account struct {
+		Name        string `json:"name"`
+		AccessToken string `json:"access_token"`
+		Note        string `json:"note"`
+	}
+	secrets := credentialValues(map[string]string{"imgur_pass": "s3cretpw", "imgur_user": "bob", "tls": "1"})
+	ev := OutputEvent{
+		Type: "error",
+		Msg:  "login as bob with s3cretpw failed: password=abc123&next=/ token: xyz.789 (Authorization: Bearer abcdefghijkl)",
+		Data: []account{{Name: "bob", AccessToken: "tok-1", Note: "retry with s3cretpw"}},
+	}
+	got := redactEvent(ev, secrets)
+	for _, leak := range []string{"s3cretpw", "abc123", "xyz.789", "abcdefghijkl"} {
+		if strings.Contains(got.Msg, leak) {
+			t.Errorf("message leaks %q: %s", leak, got.Msg)
+		}
+	}
+	if !strings.Contains(got.Msg, "login as bob") || !strings.Contains(got.Msg, "next=/") {
+		t.Errorf("message lost non-secret text: %s", got.Msg)
+	}
+	b, _ := json.Marshal(got.Data)
+	if strings.Contains(string(b), "tok-1") || strings.Contains(string(b), "s3cretpw") || !strings.Contains(string(b), `"name":"bob"`) {
+		t.Errorf("typed data not redacted: %s", b)
+	}
+	if ev.Data.([]account)[0].AccessToken != "tok-1" {
+		t.Error("redaction must not modify the original event")
+	}
+
+	nested := redactEvent(OutputEvent{Data: map[string]interface{}{"gallery": map[string]string{"gallery_secret": "g1"}}}, nil)
+	if b, _ := json.Marshal(nested.Data); strings.Contains(string(b), "g1") {
+		t.Errorf("nested secret not redacted: %s", b)
+	}
+}
+
+func TestLogsAndEventsRedactRunningJobsSecrets(t *testing.T) {
+	release := liveSecrets.add(map[string]string{"vg_pass": "hunter22", "vg_user": "bobby"})
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	log.WithField("body", `<input type="hidden" name="sess_id" value="abc999">`).WithError(errors.New("login with hunter22 failed")).Error("POST password=hunter22&PHPSESSID=zz11")
+	events := captureEvents(t, func() {
+		sendJobEvent(&JobRequest{}, OutputEvent{Type: "error", Msg: "host said: bad password hunter22 for bobby"})
+		sendJobEvent(&JobRequest{}, OutputEvent{Type: "data", Data: map[string]string{"page": `form "hunter22" sent`, "file": "/home/bobby/a.jpg"}})
+	})
+	for _, leak := range []string{"hunter22", "abc999", "zz11"} {
+		if strings.Contains(logged.String(), leak) {
+			t.Errorf("log leaks %q: %s", leak, logged.String())
+		}
+	}
+	// User names are not secrets, so they stay readable
+	if len(events) != 2 || strings.Contains(events[0].Msg, "hunter22") || !strings.Contains(events[0].Msg, "for bobby") {
+		t.Fatalf("events %+v", events)
+	}
+	if data := events[1].Data.(map[string]interface{}); data["page"] != `form "`+redactedValue+`" sent` || data["file"] != "/home/bobby/a.jpg" {
+		t.Errorf("event data %v", data)
+	}
+
+	// Once the job is over its values are no longer masked
+	release()
+	events = captureEvents(t, func() { sendJSON(OutputEvent{Type: "log", Msg: "hunter22"}) })
+	if events[0].Msg != "hunter22" {
+		t.Errorf("finished job's value still masked: %q", events[0].Msg)
+	}
+}
+
+func TestExportLogRedactsSecrets(t *testing.T) {
+	job := &JobRequest{ID: "export-secret", Action: "upload", Service: "jpg.church", Files: []string{"/tmp/a.jpg"}}
+	job.record, _ = jobs.register(job)
+	meta := map[string]string{"gallery_access": "password", "gallery_password": "hunter2"}
+	captureEvents(t, func() {
+		sendJobEvent(job, OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://jpg5.su/img/a", Data: meta})
+		sendJobEvent(job, OutputEvent{Type: "data", Data: map[string]interface{}{"deletehash": "del123"}})
+	})
+	jobs.finish(job.record)
+	if meta["gallery_password"] != "hunter2" {
+		t.Error("redaction must not modify the event sent to the UI")
+	}
+
+	for _, format := range []string{"json", "html"} {
+		path := filepath.Join(t.TempDir(), "report."+format)
+		captureEvents(t, func() {
+			handleJob(context.Background(), JobRequest{Action: "export_log", Config: map[string]string{"job_id": "export-secret", "format": format, "path": path}})
+		})
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "hunter2") || strings.Contains(string(b), "del123") {
+			t.Errorf("%s report leaks a secret:\n%s", format, b)
+		}
+		if !strings.Contains(string(b), "gallery_access") {
+			t.Errorf("%s report dropped non-secret metadata:\n%s", format, b)
+		}
+	}
+}
+
+// --- Result Spool Tests ---
+
+func TestResultSpoolRecoversCompletedFiles(t *testing.T) {
+	dir := useTempStateDir(t)
+
+	job := &JobRequest{ID: "spool-1", Action: "upload", Service: "imx.to"}
+	captureEvents(t, func() {
+		sendJobEvent(job, OutputEvent{Type: "result", FilePath: "/tmp/a.jpg", Url: "https://imx.to/i/a", Thumb: "https://imx.to/t/a"})
+		sendJobEvent(job, OutputEvent{Type: "status", FilePath: "/tmp/b.jpg", Status: "Failed"})
+		sendJobEvent(job, OutputEvent{Type: "result", FilePath: "/tmp/c.jpg", Url: "https://imx.to/i/c"})
+	})
+	// Simulate the sidecar dying halfway through a write
+	f, err := os.OpenFile(filepath.Join(dir, "results", "spool-1.jsonl"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("spool not written: %v", err)
+	}
+	f.WriteString(`{"job_id":"spool-1","fi`)
+	f.Close()
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "recover_results", Config: map[string]string{"job_id": "spool-1"}})
+	})
+	if len(events) != 1 || events[0].Type != "data" || events[0].Status != "success" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	b, _ := json.Marshal(events[0].Data)
+	var got []spooledResult
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to decode results: %v", err)
+	}
+	if len(got) != 2 || got[0].File != "/tmp/a.jpg" || got[0].Thumb != "https://imx.to/t/a" || got[1].Url != "https://imx.to/i/c" {
+		t.Errorf("unexpected recovered results: %+v", got)
+	}
+
+	events = captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "recover_results"})
+	})
+	all, _ := events[0].Data.(map[string]interface{})
+	if len(all) != 1 || all["spool-1"] == nil {
+		t.Errorf("unexpected results for all jobs: %+v", events[0].Data)
+	}
+
+	events = captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "recover_results", Config: map[string]string{"job_id": "missing"}})
+	})
+	if len(events) != 1 || events[0].Status != "failed" {
+		t.Errorf("expected failure for unknown job, got %+v", events)
+	}
+}
+
+func TestResultSpoolConcurrentResults(t *testing.T) {
+	dir := useTempStateDir(t)
+	job := &JobRequest{ID: "spool-2", Action: "upload", Service: "imx.to"}
+	rec, err := jobs.register(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.record = rec
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spoolResult(rec, OutputEvent{JobID: job.ID, FilePath: fmt.Sprintf("/tmp/%d.jpg", i), Url: fmt.Sprintf("https://imx.to/i/%d", i)})
+		}()
+	}
+	wg.Wait()
+	jobs.finish(rec)
+	rec.spool.mu.Lock()
+	open := rec.spool.f != nil
+	rec.spool.mu.Unlock()
+	if open {
+		t.Error("spool file still open after the job finished")
+	}
+
+	results, err := readResultSpool(job.ID)
+	if err != nil || len(results) != 40 {
+		t.Fatalf("recovered %d results (%v), want 40", len(results), err)
+	}
+	seen := map[string]bool{}
+	for _, r := range results {
+		seen[r.File] = true
+	}
+	if len(seen) != 40 {
+		t.Errorf("results were lost or torn: %d distinct files", len(seen))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "results", "spool-2.jsonl")); err != nil {
+		t.Errorf("spool missing: %v", err)
+	}
+}
+
+func TestRenderHTMLGallery(t *testing.T) {
+	useTempStateDir(t)
+	rec, err := jobs.register(&JobRequest{ID: "gallery-1", Action: "upload", Service: "imgbox.com", Files: []string{"/p/a.jpg", "/p/b.jpg", "/p/c.jpg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.apply(OutputEvent{Type: "result", FilePath: "/p/a.jpg", Url: "https://host.example/i/a.jpg", Thumb: "https://host.example/t/a.jpg"})
+	rec.apply(OutputEvent{Type: "result", FilePath: "/p/b.jpg", Url: "https://host.example/view/b", Thumb: "https://host.example/t/b.jpg"})
+	rec.apply(OutputEvent{Type: "error", FilePath: "/p/c.jpg", Msg: "boom"})
+
+	out := filepath.Join(t.TempDir(), "gallery.html")
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "render_html_gallery", Config: map[string]string{"job_id": rec.ID, "title": "Trip <2024>", "path": out}})
+	})
+	if len(events) != 1 || events[0].Status != "success" {
+		t.Fatalf("render_html_gallery sent %+v", events)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(b)
+	for _, want := range []string{
+		"<title>Trip &lt;2024&gt;</title>",
+		`<img src="https://host.example/i/a.jpg" alt="a.jpg">`, // a direct link opens in the lightbox
+		`<img src="https://host.example/t/b.jpg" alt="b.jpg">`, // a viewer page shows the thumbnail
+		`<a href="https://host.example/view/b">b.jpg</a>`,
+		`<a href="#img2">&rarr;</a>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("gallery page lacks %s", want)
+		}
+	}
+	if strings.Contains(page, "c.jpg") {
+		t.Error("gallery page lists a file that failed to upload")
+	}
+
+	events = captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "render_html_gallery", Config: map[string]string{"job_id": "no-such-job"}})
+	})
+	if len(events) != 1 || events[0].Status != "failed" {
+		t.Errorf("gallery of an unknown job sent %+v", events)
+	}
+}
+
+// --- Credential Store Tests ---
+
+func TestCredsProfilesInEncryptedFile(t *testing.T) {
+	dir := useTempStateDir(t)
+	old := credsStoreMode
+	credsStoreMode = "file"
+	t.Cleanup(func() { credsStoreMode = old })
+	t.Setenv(CredsPassphraseEnv, "first passphrase")
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "store_creds", CredsProfile: "main", Creds: map[string]string{"imx_user": "me", "imx_pass": "s3cret"}})
+		handleJob(context.Background(), JobRequest{Action: "get_creds", CredsProfile: "main"})
+		handleJob(context.Background(), JobRequest{Action: "get_creds", CredsProfile: "main", Config: map[string]string{"reveal": "true"}})
+	})
+	if len(events) != 3 || events[0].Status != "success" {
+		t.Fatalf("events %+v", events)
+	}
+	if data := events[1].Data.(map[string]interface{}); fmt.Sprint(data["keys"]) != "[imx_pass imx_user]" || data["creds"] != nil {
+		t.Errorf("get_creds returned %v", data)
+	}
+	// The values never go out in an event, asked for or not
+	if data := events[2].Data.(map[string]interface{}); data["creds"] != nil {
+		t.Errorf("get_creds with reveal returned %v", data)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "credentials.enc")); len(b) == 0 || strings.Contains(string(b), "s3cret") {
+		t.Errorf("creds file holds %q", b)
+	}
+
+	// A job's own creds win over the profile's
+	job := JobRequest{CredsProfile: "main", Creds: map[string]string{"imx_pass": "override"}}
+	if err := applyCredsProfile(&job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Creds["imx_user"] != "me" || job.Creds["imx_pass"] != "override" {
+		t.Errorf("merged creds %v", job.Creds)
+	}
+
+	// Another passphrase cannot open the profile, and without one the file is refused
+	t.Setenv(CredsPassphraseEnv, "passphrase")
+	if _, _, err := loadCredsProfile("main"); err == nil {
+		t.Error("profile opened under a different key")
+	}
+	t.Setenv(CredsPassphraseEnv, "")
+	if _, _, err := loadCredsProfile("main"); err == nil || !strings.Contains(err.Error(), CredsPassphraseEnv) {
+		t.Errorf("file store without a passphrase: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "credentials.key")); !os.IsNotExist(err) {
+		t.Errorf("a key file was written beside the creds file: %v", err)
+	}
+	t.Setenv(CredsPassphraseEnv, "first passphrase")
+
+	events = captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "delete_creds", CredsProfile: "main"})
+		handleJob(context.Background(), JobRequest{Action: "upload", Service: "imx.to", CredsProfile: "main", Files: []string{"a.jpg"}})
+	})
+	if len(events) != 2 || events[0].Status != "success" || events[1].Type != "error" || !strings.Contains(events[1].Msg, "no such creds profile") {
+		t.Errorf("events after delete %+v", events)
+	}
+}
+
+func TestCredsFileSealedByKeyFileIsReencrypted(t *testing.T) {
+	dir := useTempStateDir(t)
+	old := credsStoreMode
+	credsStoreMode = "file"
+	t.Cleanup(func() { credsStoreMode = old })
+
+	// A creds file as earlier versions wrote it, sealed under a key file beside it
+	key := bytes.Repeat([]byte{7}, 32)
+	aead, err := newCredsAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nonce, nonce, []byte(`{"imx_pass":"s3cret"}`), []byte("legacy"))
+	b, _ := json.Marshal(credsFile{Profiles: map[string]string{"legacy": base64.StdEncoding.EncodeToString(sealed)}})
+	if err := os.WriteFile(filepath.Join(dir, "credentials.enc"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "credentials.key"), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(CredsPassphraseEnv, "new passphrase")
+	creds, _, err := loadCredsProfile("legacy")
+	if err != nil || creds["imx_pass"] != "s3cret" {
+		t.Fatalf("legacy profile = %v, %v", creds, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "credentials.key")); !os.IsNotExist(err) {
+		t.Errorf("key file kept after re-encryption: %v", err)
+	}
+	var f credsFile
+	if b, _ := os.ReadFile(filepath.Join(dir, "credentials.enc")); json.Unmarshal(b, &f) != nil || f.Salt == "" {
+		t.Errorf("creds file not re-encrypted under the passphrase: %s", b)
+	}
+	if creds, _, err := loadCredsProfile("legacy"); err != nil || creds["imx_pass"] != "s3cret" {
+		t.Errorf("re-encrypted profile = %v, %v", creds, err)
+	}
+}
+
+func TestCredsProfilesInSecretService(t *testing.T) {
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\ncase \"$1\" in\nstore) /bin/cat > %[1]s/\"$7\" ;;\nlookup) [ -f %[1]s/\"$5\" ] || exit 1; /bin/cat %[1]s/\"$5\" ;;\nclear) /bin/rm -f %[1]s/\"$5\" ;;\nesac\n", dir)
+	if err := os.WriteFile(filepath.Join(dir, "secret-tool"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	oldDir := stateDir
+	stateDir = ""
+	t.Cleanup(func() { stateDir = oldDir })
+
+	events := captureEvents(t, func() {
+		handleJob(context.Background(), JobRequest{Action: "store_creds", CredsProfile: "alt", Creds: map[string]string{"vg_user": "me"}})
+	})
+	if len(events) != 1 || events[0].Status != "success" || events[0].Data.(map[string]interface{})["store"] != "secret-service" {
+		t.Fatalf("store_creds events %+v", events)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "alt")); strings.Contains(string(b), "me") {
+		t.Errorf("keychain entry %q is not encoded", b)
+	}
+	creds, store, err := loadCredsProfile("alt")
+	if err != nil || store != "secret-service" || creds["vg_user"] != "me" {
+		t.Errorf("loadCredsProfile = %v, %q, %v", creds, store, err)
+	}
+	if _, _, err := loadCredsProfile("missing"); !errors.Is(err, errCredsNotFound) {
+		t.Errorf("missing profile: %v", err)
+	}
+}
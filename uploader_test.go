@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -294,6 +295,44 @@ func initHTTPClient() {
 	}
 }
 
+// captureEvents runs fn while capturing stdout and returns the OutputEvents it emitted
+func captureEvents(t *testing.T, fn func()) []OutputEvent {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	oldStdout := stdout
+	stdout = newEventOutput(w)
+
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- b
+	}()
+
+	func() {
+		defer func() { stdout = oldStdout }()
+		fn()
+	}()
+	_ = w.Close()
+	raw := <-done
+
+	var events []OutputEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		if line == "" {
+			continue
+		}
+		var ev OutputEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("Invalid JSON event %q: %v", line, err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
 // createTestImage creates a simple 100x100 white JPEG image for testing
 func createTestImage(path string) error {
 	// Create a 100x100 white image
@@ -350,7 +389,7 @@ func TestHandleJobInvalidAction(t *testing.T) {
 		}
 	}()
 
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 func TestHandleJobMissingFiles(t *testing.T) {
@@ -366,7 +405,7 @@ func TestHandleJobMissingFiles(t *testing.T) {
 		}
 	}()
 
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 func TestHandleJobNonexistentFile(t *testing.T) {
@@ -382,7 +421,7 @@ func TestHandleJobNonexistentFile(t *testing.T) {
 		}
 	}()
 
-	handleJob(job)
+	handleJob(context.Background(), job)
 }
 
 // --- File Processing Tests ---
@@ -401,7 +440,7 @@ func TestProcessFileNonexistent(t *testing.T) {
 		}
 	}()
 
-	processFile("/nonexistent/file.jpg", &job)
+	processFile(context.Background(), "/nonexistent/file.jpg", &job)
 }
 
 func TestProcessFileUnsupportedService(t *testing.T) {
@@ -423,5 +462,5 @@ func TestProcessFileUnsupportedService(t *testing.T) {
 		}
 	}()
 
-	processFile(testImagePath, &job)
+	processFile(context.Background(), testImagePath, &job)
 }